@@ -0,0 +1,230 @@
+package memoise
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"sort"
+	"unsafe"
+)
+
+var binaryMarshaler = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+
+// FuncKey - the cache key Func and FuncCtx use for the given name and argument
+// e.g. to Unset or Refresh the entry for a specific argument
+func FuncKey(name string, arg interface{}) (string, error) {
+	return argKey(name, arg)
+}
+
+// argKey - cache key for a memoised function argument: name + stable hash of the argument
+func argKey(name string, arg interface{}) (string, error) {
+	enc := argEncoder{
+		seen: map[visit]struct{}{},
+	}
+	if err := enc.encode(reflect.ValueOf(arg)); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(enc.buf.Bytes())
+	return name + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// argEncoder - deterministic encoding of values: pointers are dereferenced, map entries sorted by key
+type argEncoder struct {
+	buf  bytes.Buffer
+	seen map[visit]struct{} // pointers, maps and slices being encoded, to detect cycles
+}
+
+// visit - reference being encoded, slices of different lengths can share the same pointer
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// accessible - get a value that can be used as interface{}, so methods like MarshalBinary can be called
+// values of unexported fields are read through their address, other values are copied to make them addressable
+func accessible(v reflect.Value) reflect.Value {
+	if !v.CanInterface() {
+		if v.CanAddr() {
+			return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+		}
+		return v
+	}
+	if !v.CanAddr() && (v.Kind() == reflect.Struct || v.Kind() == reflect.Array) {
+		// fields and elements of an addressable copy are addressable, too
+		cp := reflect.New(v.Type()).Elem()
+		cp.Set(v)
+		return cp
+	}
+	return v
+}
+
+// enter - mark reference as being encoded, returns false if it already is (the value contains itself)
+func (a *argEncoder) enter(r visit) bool {
+	if _, ok := a.seen[r]; ok {
+		return false
+	}
+	a.seen[r] = struct{}{}
+	return true
+}
+
+func (a *argEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		a.buf.WriteByte(byte(reflect.Invalid))
+		return nil
+	}
+	v = accessible(v)
+	a.buf.WriteByte(byte(v.Kind()))
+	// types like time.Time have an internal representation that isn't stable (monotonic clock)
+	if v.Kind() != reflect.Ptr && v.Type().Implements(binaryMarshaler) && v.CanInterface() {
+		b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		a.bytes(b)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			a.uint(1)
+		} else {
+			a.uint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		a.uint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		a.uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		a.uint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		a.uint(math.Float64bits(real(c)))
+		a.uint(math.Float64bits(imag(c)))
+	case reflect.String:
+		a.bytes([]byte(v.String()))
+	case reflect.Ptr:
+		if v.IsNil() {
+			a.uint(0)
+			return nil
+		}
+		r := visit{ptr: v.Pointer(), typ: v.Type()}
+		if !a.enter(r) {
+			return ErrUnsupportedArg
+		}
+		a.uint(1)
+		err := a.encode(v.Elem())
+		delete(a.seen, r)
+		return err
+	case reflect.Interface:
+		if v.IsNil() {
+			a.uint(0)
+			return nil
+		}
+		a.uint(1)
+		// different types with the same representation should not share a key
+		a.bytes([]byte(v.Elem().Type().String()))
+		return a.encode(v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		a.uint(uint64(v.NumField()))
+		for i := 0; i < v.NumField(); i++ {
+			a.bytes([]byte(t.Field(i).Name))
+			if err := a.encode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			a.uint(0)
+			return nil
+		}
+		a.uint(uint64(v.Len()) + 1)
+		if v.Kind() == reflect.Slice && v.Len() > 0 {
+			r := visit{ptr: v.Pointer(), typ: v.Type(), len: v.Len()}
+			if !a.enter(r) {
+				return ErrUnsupportedArg
+			}
+			err := a.encodeElems(v)
+			delete(a.seen, r)
+			return err
+		}
+		return a.encodeElems(v)
+	case reflect.Map:
+		return a.encodeMap(v)
+	default:
+		// chan, func, unsafe pointer
+		return ErrUnsupportedArg
+	}
+	return nil
+}
+
+// encodeElems - encode the elements of a slice or array
+func (a *argEncoder) encodeElems(v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := a.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMap - encode a map, unless it contains itself
+func (a *argEncoder) encodeMap(v reflect.Value) error {
+	if v.IsNil() {
+		a.uint(0)
+		return nil
+	}
+	r := visit{ptr: v.Pointer(), typ: v.Type()}
+	if !a.enter(r) {
+		return ErrUnsupportedArg
+	}
+	err := a.encodePairs(v)
+	delete(a.seen, r)
+	return err
+}
+
+// encodePairs - encode map entries sorted by their encoded keys, see encodeMap
+func (a *argEncoder) encodePairs(v reflect.Value) error {
+	type pair struct {
+		k, v []byte
+	}
+	pairs := make([]pair, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		ke := argEncoder{seen: a.seen}
+		if err := ke.encode(iter.Key()); err != nil {
+			return err
+		}
+		ve := argEncoder{seen: a.seen}
+		if err := ve.encode(iter.Value()); err != nil {
+			return err
+		}
+		pairs = append(pairs, pair{k: ke.buf.Bytes(), v: ve.buf.Bytes()})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].k, pairs[j].k) < 0
+	})
+	a.uint(uint64(len(pairs)) + 1)
+	for _, p := range pairs {
+		a.bytes(p.k)
+		a.bytes(p.v)
+	}
+	return nil
+}
+
+func (a *argEncoder) uint(u uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], u)
+	a.buf.Write(b[:])
+}
+
+// bytes - length prefixed, so adjacent values can't run into each other
+func (a *argEncoder) bytes(b []byte) {
+	a.uint(uint64(len(b)))
+	a.buf.Write(b)
+}
@@ -0,0 +1,84 @@
+package memoise
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher - collects keys requested through GetMulti within a window, and loads them using a single call
+type batcher struct {
+	mu     *sync.Mutex
+	c      *cache
+	call   BatchCall
+	window time.Duration
+	cur    *batch // batch currently collecting keys, nil if none
+}
+
+type batch struct {
+	keys map[string]struct{}
+	vals map[string]interface{}
+	errs map[string]error
+	done chan struct{} // closed once the results are available
+}
+
+func newBatcher(c *cache, call BatchCall) *batcher {
+	return &batcher{
+		mu:     &sync.Mutex{},
+		c:      c,
+		call:   call,
+		window: DefaultBatchWindow,
+	}
+}
+
+// load - add keys to the current batch, and wait for the results
+func (b *batcher) load(keys []string) *batch {
+	b.mu.Lock()
+	if b.cur == nil {
+		b.cur = &batch{
+			keys: map[string]struct{}{},
+			done: make(chan struct{}),
+		}
+		cur := b.cur
+		// the window merges concurrent requests, it's not related to expiry, so it uses the actual time
+		// with a fake clock, GetMulti would block until the clock is advanced
+		time.AfterFunc(b.window, func() {
+			b.dispatch(cur)
+		})
+	}
+	for _, k := range keys {
+		b.cur.keys[k] = struct{}{}
+	}
+	bt := b.cur
+	b.mu.Unlock()
+	<-bt.done
+	return bt
+}
+
+// dispatch - stop collecting keys, call the BatchCall and store the results in the cache
+func (b *batcher) dispatch(bt *batch) {
+	b.mu.Lock()
+	if b.cur == bt {
+		b.cur = nil
+	}
+	b.mu.Unlock()
+	keys := make([]string, 0, len(bt.keys))
+	for k := range bt.keys {
+		keys = append(keys, k)
+	}
+	vals, errs := b.call(keys)
+	bt.vals, bt.errs = b.c.storeBatch(keys, vals, errs)
+	close(bt.done)
+}
+
+// single - Call used to refresh entries created by a batch, loading just the one key
+func (b *batcher) single(k string) Call {
+	return func() (interface{}, error) {
+		vals, errs := b.call([]string{k})
+		v, vok := vals[k]
+		err, eok := errs[k]
+		if !vok && !eok {
+			return nil, ErrKeyNotFound
+		}
+		return v, err
+	}
+}
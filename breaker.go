@@ -0,0 +1,85 @@
+package memoise
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breakerState int
+
+type breakerConf struct {
+	threshold int           // consecutive failures before opening, 0 disables the breaker
+	coolDown  time.Duration // time the breaker stays open before letting a call through
+}
+
+// breaker - per entry circuit breaker, methods are safe to call on a nil breaker
+type breaker struct {
+	mu       *sync.Mutex
+	clock    Clock
+	conf     breakerConf
+	state    breakerState
+	failures int
+	opened   time.Time
+}
+
+func newBreaker(conf breakerConf, clock Clock) *breaker {
+	if conf.threshold <= 0 {
+		return nil
+	}
+	return &breaker{
+		mu:    &sync.Mutex{},
+		clock: clock,
+		conf:  conf,
+	}
+}
+
+// allow - check whether or not a call can be made
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	switch b.state {
+	case breakerOpen:
+		if b.clock.Now().Sub(b.opened) < b.conf.coolDown {
+			b.mu.Unlock()
+			return false
+		}
+		// let a single call through
+		b.state = breakerHalfOpen
+		b.mu.Unlock()
+		return true
+	case breakerHalfOpen:
+		// probe call is in progress
+		b.mu.Unlock()
+		return false
+	}
+	b.mu.Unlock()
+	return true
+}
+
+// done - register the outcome of a call that was allowed
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		b.mu.Unlock()
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.conf.threshold {
+		b.state = breakerOpen
+		b.opened = b.clock.Now()
+	}
+	b.mu.Unlock()
+}
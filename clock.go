@@ -0,0 +1,27 @@
+package memoise
+
+import "time"
+
+// Clock - source of time used by the cache, the default uses the time package
+// a fake clock for testing can be found in the clocktest package
+type Clock interface {
+	Now() time.Time
+	// AfterFunc - call f in its own goroutine once the duration has elapsed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer - handle returned by Clock.AfterFunc, similar to time.Timer
+type Timer interface {
+	// Stop - prevent the timer from firing, returns false if the timer already fired or was stopped
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,119 @@
+// Package clocktest provides a fake memoise.Clock, so time based behaviour can be tested
+// without having to wait for it
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EVODelavega/go-memoise"
+)
+
+// Clock - fake clock, time only moves when Advance is called
+// functions scheduled using AfterFunc are called synchronously by Advance. Note that calls retried with
+// a backoff (see memoise.SetRetryPolicy) block until their timer fires, so Advance has to be called from
+// another goroutine for those
+type Clock struct {
+	mu     *sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+type timer struct {
+	c  *Clock
+	at time.Time
+	f  func()
+}
+
+// New - get a new fake clock set to the given time
+func New(now time.Time) *Clock {
+	return &Clock{
+		mu:  &sync.Mutex{},
+		now: now,
+	}
+}
+
+// Now - get the current (fake) time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	now := c.now
+	c.mu.Unlock()
+	return now
+}
+
+// AfterFunc - schedule f to be called once the clock has been advanced by d or more
+// functions due right away (d <= 0) are called on the next call to Advance
+func (c *Clock) AfterFunc(d time.Duration, f func()) memoise.Timer {
+	c.mu.Lock()
+	t := &timer{
+		c:  c,
+		at: c.now.Add(d),
+		f:  f,
+	}
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	return t
+}
+
+// Advance - move the clock forward, calling all functions that are due in order
+// the time is set to the due time of each function before it is called
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		t := c.pop(end)
+		if t == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.mu.Unlock()
+		// functions may well schedule new timers, don't hold the lock
+		t.f()
+	}
+}
+
+// Pending - get the number of scheduled functions that haven't been called
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	n := len(c.timers)
+	c.mu.Unlock()
+	return n
+}
+
+// pop - remove and return the first timer due at or before end, caller must hold lock
+func (c *Clock) pop(end time.Time) *timer {
+	if len(c.timers) == 0 {
+		return nil
+	}
+	// stable sort, so timers due at the same time fire in the order they were added
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+	t := c.timers[0]
+	if t.at.After(end) {
+		return nil
+	}
+	c.timers = c.timers[1:]
+	return t
+}
+
+// Stop - stop the timer, returns false if it already fired or was stopped
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	for i, o := range t.c.timers {
+		if o == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			t.c.mu.Unlock()
+			return true
+		}
+	}
+	t.c.mu.Unlock()
+	return false
+}
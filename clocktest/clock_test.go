@@ -0,0 +1,40 @@
+package clocktest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EVODelavega/go-memoise/clocktest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvance(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.New(start)
+	fired := []time.Time{}
+	clock.AfterFunc(2*time.Second, func() {
+		fired = append(fired, clock.Now())
+	})
+	clock.AfterFunc(time.Second, func() {
+		fired = append(fired, clock.Now())
+		// timers scheduled while advancing fire if they're due
+		clock.AfterFunc(time.Second/2, func() {
+			fired = append(fired, clock.Now())
+		})
+	})
+	stopped := clock.AfterFunc(time.Second, func() {
+		t.Fatal("stopped timer fired")
+	})
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+	clock.Advance(time.Second / 2)
+	assert.Empty(t, fired)
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, []time.Time{
+		start.Add(time.Second),
+		start.Add(3 * time.Second / 2),
+		start.Add(2 * time.Second),
+	}, fired)
+	assert.Equal(t, start.Add(11*time.Second/2), clock.Now())
+	assert.Equal(t, 0, clock.Pending())
+}
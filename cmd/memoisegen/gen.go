@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	annotation  = "memoise:"
+	memoisePath = "github.com/EVODelavega/go-memoise"
+)
+
+// reserved - identifiers used by the generated code
+var reserved = map[string]struct{}{
+	"m":       {},
+	"a":       {},
+	"ctx":     {},
+	"next":    {},
+	"cache":   {},
+	"context": {},
+	"memoise": {},
+	"time":    {},
+}
+
+// method - a memoised interface method
+type method struct {
+	name     string
+	ctx      bool // first argument is a context.Context, it's not part of the key
+	params   []param
+	variadic bool
+	result   string
+	ttl      string // TTL expression, empty to use the cache default
+}
+
+type param struct {
+	name, typ string
+}
+
+// generate - generate the memoising wrapper for interface typeName, declared in one of the src files
+func generate(typeName string, src map[string][]byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	names := make([]string, 0, len(src))
+	for n := range src {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		f, err := parser.ParseFile(fset, n, src[n], parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		it := findInterface(f, typeName)
+		if it == nil {
+			continue
+		}
+		methods, err := parseMethods(fset, it)
+		if err != nil {
+			return nil, err
+		}
+		if len(methods) == 0 {
+			// the wrapper would be pointless, and its imports unused
+			return nil, fmt.Errorf("interface %s has no methods annotated with memoise:", typeName)
+		}
+		return render(f, typeName, methods)
+	}
+	return nil, fmt.Errorf("interface %s not found", typeName)
+}
+
+func findInterface(f *ast.File, name string) *ast.InterfaceType {
+	for _, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, s := range gd.Specs {
+			ts := s.(*ast.TypeSpec)
+			if ts.Name.Name != name {
+				continue
+			}
+			if it, ok := ts.Type.(*ast.InterfaceType); ok {
+				return it
+			}
+		}
+	}
+	return nil
+}
+
+// parseMethods - get the annotated methods of the interface
+func parseMethods(fset *token.FileSet, it *ast.InterfaceType) ([]method, error) {
+	var methods []method
+	for _, f := range it.Methods.List {
+		ft, ok := f.Type.(*ast.FuncType)
+		// embedded interfaces are passed through
+		if !ok || len(f.Names) == 0 {
+			continue
+		}
+		name := f.Names[0].Name
+		ttl, ok, err := parseAnnotation(f.Doc)
+		if err != nil {
+			return nil, fmt.Errorf("method %s: %v", name, err)
+		}
+		if !ok {
+			continue
+		}
+		m := method{
+			name: name,
+			ttl:  ttl,
+		}
+		if ft.Results == nil || len(ft.Results.List) != 2 || len(ft.Results.List[0].Names) > 1 || expr(fset, ft.Results.List[1].Type) != "error" {
+			return nil, fmt.Errorf("method %s: memoised methods must return a value and an error", name)
+		}
+		m.result = expr(fset, ft.Results.List[0].Type)
+		for _, p := range ft.Params.List {
+			typ := expr(fset, p.Type)
+			if ell, ok := p.Type.(*ast.Ellipsis); ok {
+				m.variadic = true
+				typ = "[]" + expr(fset, ell.Elt)
+			}
+			if len(p.Names) == 0 {
+				m.params = append(m.params, param{typ: typ})
+				continue
+			}
+			for _, n := range p.Names {
+				m.params = append(m.params, param{name: n.Name, typ: typ})
+			}
+		}
+		if len(m.params) > 0 && m.params[0].typ == "context.Context" {
+			m.ctx = true
+			m.params = m.params[1:]
+		}
+		for i := range m.params {
+			// unnamed or blank parameters
+			if m.params[i].name == "" || m.params[i].name == "_" {
+				m.params[i].name = fmt.Sprintf("p%d", i)
+			}
+			// avoid clashing with the names used in generated code
+			if _, ok := reserved[m.params[i].name]; ok {
+				m.params[i].name += "Arg"
+			}
+		}
+		methods = append(methods, m)
+	}
+	return methods, nil
+}
+
+// parseAnnotation - look for a memoise: line in the doc comment, returns the TTL expression
+func parseAnnotation(doc *ast.CommentGroup) (string, bool, error) {
+	if doc == nil {
+		return "", false, nil
+	}
+	for _, c := range doc.List {
+		line := strings.TrimSpace(strings.TrimPrefix(c.Text, "//"))
+		if !strings.HasPrefix(line, annotation) {
+			continue
+		}
+		ttl := ""
+		for _, opt := range strings.Fields(strings.TrimPrefix(line, annotation)) {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 || kv[0] != "ttl" {
+				return "", false, fmt.Errorf("unknown annotation option %q", opt)
+			}
+			d, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return "", false, err
+			}
+			ttl = durationExpr(d)
+		}
+		return ttl, true, nil
+	}
+	return "", false, nil
+}
+
+// durationExpr - readable Go expression for d
+func durationExpr(d time.Duration) string {
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{time.Hour, "time.Hour"},
+		{time.Minute, "time.Minute"},
+		{time.Second, "time.Second"},
+		{time.Millisecond, "time.Millisecond"},
+	}
+	for _, u := range units {
+		if d%u.d == 0 {
+			return fmt.Sprintf("%d * %s", d/u.d, u.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", d)
+}
+
+func expr(fset *token.FileSet, e ast.Expr) string {
+	var b bytes.Buffer
+	_ = printer.Fprint(&b, fset, e)
+	return b.String()
+}
+
+// render - write the wrapper source
+func render(f *ast.File, typeName string, methods []method) ([]byte, error) {
+	var b bytes.Buffer
+	wrapper := "Memoised" + typeName
+	fmt.Fprintf(&b, "// Code generated by memoisegen; DO NOT EDIT.\n\npackage %s\n\n", f.Name.Name)
+	b.WriteString("import (\n")
+	for i, group := range imports(f, methods) {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, imp := range group {
+			fmt.Fprintf(&b, "\t%s\n", imp)
+		}
+	}
+	b.WriteString(")\n\n")
+	for _, m := range methods {
+		fmt.Fprintf(&b, "type %s struct {\n", argsType(typeName, m))
+		for _, p := range m.params {
+			fmt.Fprintf(&b, "\t%s %s\n", p.name, p.typ)
+		}
+		b.WriteString("}\n\n")
+	}
+	fmt.Fprintf(&b, "// %s - %s memoising the results of annotated methods, other methods are passed through\n", wrapper, typeName)
+	fmt.Fprintf(&b, "type %s struct {\n\t%s\n", wrapper, typeName)
+	for _, m := range methods {
+		fmt.Fprintf(&b, "\t%s func(context.Context, %s) (%s, error)\n", field(m), argsType(typeName, m), m.result)
+	}
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "// New%s - wrap next, caching results in cache\n", wrapper)
+	fmt.Fprintf(&b, "func New%s(next %s, cache memoise.Cache) *%s {\n", wrapper, typeName, wrapper)
+	fmt.Fprintf(&b, "\tm := &%s{\n\t\t%s: next,\n\t}\n", wrapper, typeName)
+	for _, m := range methods {
+		ctx := "_"
+		if m.ctx {
+			ctx = "ctx"
+		}
+		fmt.Fprintf(&b, "\tm.%s = memoise.FuncCtx(cache, %s, func(%s context.Context, a %s) (%s, error) {\n",
+			field(m), strconv.Quote(typeName+"."+m.name), ctx, argsType(typeName, m), m.result)
+		args := make([]string, 0, len(m.params)+1)
+		if m.ctx {
+			args = append(args, "ctx")
+		}
+		for _, p := range m.params {
+			args = append(args, "a."+p.name)
+		}
+		spread := ""
+		if m.variadic {
+			spread = "..."
+		}
+		fmt.Fprintf(&b, "\t\treturn next.%s(%s%s)\n\t}", m.name, strings.Join(args, ", "), spread)
+		if m.ttl != "" {
+			fmt.Fprintf(&b, ", memoise.SetTTL(%s)", m.ttl)
+		}
+		b.WriteString(")\n")
+	}
+	b.WriteString("\treturn m\n}\n")
+	for _, m := range methods {
+		params := make([]string, 0, len(m.params)+1)
+		fields := make([]string, 0, len(m.params))
+		ctx := ""
+		if m.ctx {
+			params = append(params, "ctx context.Context")
+			ctx = "ctx"
+		}
+		for i, p := range m.params {
+			typ := p.typ
+			if m.variadic && i == len(m.params)-1 {
+				typ = "..." + strings.TrimPrefix(typ, "[]")
+			}
+			params = append(params, p.name+" "+typ)
+			fields = append(fields, p.name+": "+p.name)
+		}
+		fmt.Fprintf(&b, "\n// %s - memoised\n", m.name)
+		fmt.Fprintf(&b, "func (m *%s) %s(%s) (%s, error) {\n", wrapper, m.name, strings.Join(params, ", "), m.result)
+		if !m.ctx {
+			// method doesn't take a context, so there is none to pass on
+			ctx = "context.Background()"
+		}
+		fmt.Fprintf(&b, "\treturn m.%s(%s, %s{%s})\n}\n", field(m), ctx, argsType(typeName, m), strings.Join(fields, ", "))
+	}
+	return format.Source(b.Bytes())
+}
+
+// imports - imports needed by the generated code, the standard library first, then everything else
+func imports(f *ast.File, methods []method) [][]string {
+	used := map[string]struct{}{}
+	for _, m := range methods {
+		types := []string{m.result}
+		for _, p := range m.params {
+			types = append(types, p.typ)
+		}
+		for _, t := range types {
+			e, err := parser.ParseExpr(t)
+			if err != nil {
+				continue
+			}
+			ast.Inspect(e, func(n ast.Node) bool {
+				if sel, ok := n.(*ast.SelectorExpr); ok {
+					if id, ok := sel.X.(*ast.Ident); ok {
+						used[id.Name] = struct{}{}
+					}
+				}
+				return true
+			})
+		}
+	}
+	out := map[string]struct{}{
+		strconv.Quote("context"):   {},
+		strconv.Quote(memoisePath): {},
+	}
+	for _, m := range methods {
+		if m.ttl != "" {
+			out[strconv.Quote("time")] = struct{}{}
+		}
+	}
+	for _, imp := range f.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := pkgName(path)
+		spec := imp.Path.Value
+		if imp.Name != nil {
+			name = imp.Name.Name
+			spec = name + " " + spec
+		}
+		if _, ok := used[name]; ok {
+			out[spec] = struct{}{}
+		}
+	}
+	var std, other []string
+	for s := range out {
+		path := s[strings.Index(s, `"`)+1:]
+		// standard library paths have no domain
+		if elem := strings.SplitN(path, "/", 2)[0]; strings.Contains(elem, ".") {
+			other = append(other, s)
+		} else {
+			std = append(std, s)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	return [][]string{std, other}
+}
+
+// pkgName - guess the package name from the import path, by convention
+func pkgName(path string) string {
+	name := path[strings.LastIndex(path, "/")+1:]
+	// gopkg.in/yaml.v3
+	if i := strings.Index(name, ".v"); i > 0 {
+		name = name[:i]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	return strings.Replace(name, "-", "_", -1)
+}
+
+func argsType(typeName string, m method) string {
+	return lowerFirst(typeName) + m.name + "Args"
+}
+
+func field(m method) string {
+	return "memo" + m.name
+}
+
+func lowerFirst(s string) string {
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
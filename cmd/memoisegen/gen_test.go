@@ -0,0 +1,94 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const userService = `package users
+
+import (
+	"context"
+
+	xtime "time"
+)
+
+type User struct {
+	ID int
+}
+
+type UserService interface {
+	// GetUser - get user by ID
+	// memoise:ttl=5m
+	GetUser(ctx context.Context, id int) (*User, error)
+	// memoise:
+	Search(query string, tags ...string) ([]User, error)
+	// memoise:ttl=1500ms
+	Since(context.Context, xtime.Time) ([]User, error)
+	SaveUser(ctx context.Context, u *User) error
+}
+`
+
+func TestGenerate(t *testing.T) {
+	out, err := generate("UserService", map[string][]byte{"users.go": []byte(userService)})
+	assert.NoError(t, err)
+	src := string(out)
+	for _, want := range []string{
+		"package users",
+		"import (\n\t\"context\"\n\t\"time\"\n\txtime \"time\"\n\n\t\"github.com/EVODelavega/go-memoise\"\n)",
+		"type MemoisedUserService struct {\n\tUserService\n",
+		"func NewMemoisedUserService(next UserService, cache memoise.Cache) *MemoisedUserService {",
+		`memoise.FuncCtx(cache, "UserService.GetUser"`,
+		"memoise.SetTTL(5*time.Minute)",
+		"memoise.SetTTL(1500*time.Millisecond)",
+		"return next.Search(a.query, a.tags...)",
+		"return next.Since(ctx, a.p0)",
+		"func (m *MemoisedUserService) Search(query string, tags ...string) ([]User, error) {",
+		"return m.memoGetUser(ctx, userServiceGetUserArgs{id: id})",
+	} {
+		assert.True(t, strings.Contains(src, want), "missing %q in:\n%s", want, src)
+	}
+	// SaveUser is passed through by the embedded interface
+	assert.False(t, strings.Contains(src, "SaveUser"))
+	assert.NoError(t, typeCheck(map[string]string{"users.go": userService, "users_memoise.go": src}))
+}
+
+// typeCheck - make sure the sources compile as a single package
+func typeCheck(src map[string]string) error {
+	fset := token.NewFileSet()
+	files := make([]*ast.File, 0, len(src))
+	for n, s := range src {
+		f, err := parser.ParseFile(fset, n, s, 0)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+	}
+	_, err := conf.Check("users", fset, files, nil)
+	return err
+}
+
+func TestGenerateErrors(t *testing.T) {
+	_, err := generate("Missing", map[string][]byte{"users.go": []byte(userService)})
+	assert.Error(t, err)
+	bad := strings.Replace(userService, "SaveUser(ctx", "// memoise:\n\tSaveUser(ctx", 1)
+	_, err = generate("UserService", map[string][]byte{"users.go": []byte(bad)})
+	assert.Error(t, err)
+	bad = strings.Replace(userService, "ttl=5m", "ttl=soon", 1)
+	_, err = generate("UserService", map[string][]byte{"users.go": []byte(bad)})
+	assert.Error(t, err)
+	// nothing to memoise
+	bad = strings.Replace(userService, "memoise:", "cached:", -1)
+	_, err = generate("UserService", map[string][]byte{"users.go": []byte(bad)})
+	assert.EqualError(t, err, "interface UserService has no methods annotated with memoise:")
+}
@@ -0,0 +1,66 @@
+// Command memoisegen generates a caching decorator for an interface, memoising annotated methods
+// through a memoise.Cache. Every method that isn't annotated is passed through to the wrapped value.
+//
+// Usage, next to the interface declaration:
+//
+//	//go:generate memoisegen -type UserService
+//
+//	type UserService interface {
+//		// GetUser - fetch user by ID
+//		// memoise:ttl=5m
+//		GetUser(ctx context.Context, id int) (*User, error)
+//		SaveUser(ctx context.Context, u *User) error
+//	}
+//
+// This generates a MemoisedUserService struct, created with NewMemoisedUserService(svc, cache).
+// Memoised methods must return a value and an error. The arguments, except for a leading
+// context.Context, make up the cache key. The ttl is optional, the cache default is used if omitted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeName := flag.String("type", "", "name of the interface to generate a memoising wrapper for (required)")
+	output := flag.String("output", "", "output file name, default <type>_memoise.go")
+	dir := flag.String("dir", ".", "directory of the package containing the interface")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("memoisegen: ")
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	files, err := filepath.Glob(filepath.Join(*dir, "*.go"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	src := map[string][]byte{}
+	for _, f := range files {
+		if strings.HasSuffix(f, "_test.go") {
+			continue
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src[f] = b
+	}
+	out, err := generate(*typeName, src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := *output
+	if name == "" {
+		name = fmt.Sprintf("%s_memoise.go", strings.ToLower(*typeName))
+	}
+	if err := os.WriteFile(filepath.Join(*dir, name), out, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
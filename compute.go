@@ -0,0 +1,194 @@
+package memoise
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// computeOp - what to do with the entry once the compute function returns
+type computeOp int
+
+const (
+	// computeNone - leave the entry as-is
+	computeNone computeOp = iota
+	// computeStore - store the returned value
+	computeStore
+	// computeRemove - remove the entry
+	computeRemove
+)
+
+// expired - check whether the item has expired
+func (i *citem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && i.expires.Before(now)
+}
+
+// touch - push the expiry forward after an access, no further than the write deadline
+func (i *citem) touch(now time.Time, idle time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	i.accessed = now
+	exp := now.Add(idle)
+	if !i.deadline.IsZero() && i.deadline.Before(exp) {
+		exp = i.deadline
+	}
+	i.expires = exp
+}
+
+// Compute - atomically compute a new value for key, fn gets the current value and whether it exists
+// expired values are passed as non-existent. If fn returns false, the key is removed
+// returns the value stored, or ErrKeyNotFound if the key was removed
+func (c *valCache) Compute(key string, fn ComputeFunc, opts ...EntryConfig) (interface{}, error) {
+	return c.compute(key, func(it *citem, valid bool) (interface{}, computeOp) {
+		var old interface{}
+		if valid {
+			old = it.val
+		}
+		v, ok := fn(old, valid)
+		if !ok {
+			return nil, computeRemove
+		}
+		return v, computeStore
+	}, opts...)
+}
+
+// ComputeIfAbsent - compute a value for key only if it doesn't exist (or has expired)
+// returns the existing, or computed value. If fn returns false, nothing is stored and ErrKeyNotFound is returned
+func (c *valCache) ComputeIfAbsent(key string, fn func() (interface{}, bool), opts ...EntryConfig) (interface{}, error) {
+	return c.compute(key, func(it *citem, valid bool) (interface{}, computeOp) {
+		if valid {
+			return it.val, computeNone
+		}
+		v, ok := fn()
+		if !ok {
+			return nil, computeNone
+		}
+		return v, computeStore
+	}, opts...)
+}
+
+// ComputeIfPresent - compute a new value for key only if it exists, and hasn't expired
+// if fn returns false, the key is removed. ErrKeyNotFound is returned if the key doesn't exist (anymore)
+func (c *valCache) ComputeIfPresent(key string, fn func(old interface{}) (interface{}, bool), opts ...EntryConfig) (interface{}, error) {
+	return c.compute(key, func(it *citem, valid bool) (interface{}, computeOp) {
+		if !valid {
+			return nil, computeNone
+		}
+		v, ok := fn(it.val)
+		if !ok {
+			return nil, computeRemove
+		}
+		return v, computeStore
+	}, opts...)
+}
+
+// Replace - set the value for key, only if it exists and hasn't expired
+// returns ErrKeyNotFound or ErrValueExpired if the value wasn't replaced
+func (c *valCache) Replace(key string, value interface{}, opts ...EntryConfig) error {
+	var err error
+	_, cErr := c.compute(key, func(it *citem, valid bool) (interface{}, computeOp) {
+		if it == nil {
+			err = ErrKeyNotFound
+			return nil, computeNone
+		}
+		if !valid {
+			err = ErrValueExpired
+			return nil, computeNone
+		}
+		return value, computeStore
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	return cErr
+}
+
+// Swap - set the value for key, returning the previous value
+// like Get, an expired previous value is returned along with ErrValueExpired
+// ErrKeyNotFound is returned if there was no previous value, the new value is set regardless
+func (c *valCache) Swap(key string, value interface{}, opts ...EntryConfig) (interface{}, error) {
+	var (
+		prev interface{}
+		err  = ErrKeyNotFound
+	)
+	_, cErr := c.compute(key, func(it *citem, valid bool) (interface{}, computeOp) {
+		if it != nil {
+			prev, err = it.val, nil
+			if !valid {
+				err = ErrValueExpired
+			}
+		}
+		return value, computeStore
+	}, opts...)
+	if cErr == ErrCacheClosed {
+		return nil, cErr
+	}
+	return prev, err
+}
+
+// CompareAndDelete - remove key, only if its value is equal to expected
+// eq is used to compare the values, reflect.DeepEqual if nil. Returns whether or not the key was removed
+func (c *valCache) CompareAndDelete(key string, expected interface{}, eq func(a, b interface{}) bool) bool {
+	if eq == nil {
+		eq = reflect.DeepEqual
+	}
+	deleted := false
+	_, _ = c.compute(key, func(it *citem, _ bool) (interface{}, computeOp) {
+		if it == nil || !eq(it.val, expected) {
+			return nil, computeNone
+		}
+		deleted = true
+		return nil, computeRemove
+	})
+	return deleted
+}
+
+// compute - call fn with the entry for key locked, without blocking other keys
+// fn gets the current item (nil if not set), and whether it's still valid
+func (c *valCache) compute(key string, fn func(it *citem, valid bool) (interface{}, computeOp), opts ...EntryConfig) (interface{}, error) {
+	if c.life.isClosed() {
+		return nil, ErrCacheClosed
+	}
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if !ok {
+			// placeholder, concurrent calls for the same key wait for the entry lock
+			e = &vcentry{
+				mu: &sync.RWMutex{},
+			}
+			c.entries[key] = e
+		}
+		c.mu.Unlock()
+		e.mu.Lock()
+		if e.removed {
+			// removed while we were waiting for the lock, start over
+			e.mu.Unlock()
+			continue
+		}
+		valid := e.item != nil && !e.item.expired(c.clock.Now())
+		v, op := fn(e.item, valid)
+		switch op {
+		case computeStore:
+			c.store(e, v, valid, opts...)
+		case computeRemove:
+			c.remove(key, e)
+		}
+		if e.item == nil && !e.removed {
+			// placeholder that didn't get a value
+			c.remove(key, e)
+		}
+		if e.item == nil {
+			e.mu.Unlock()
+			return nil, ErrKeyNotFound
+		}
+		if op == computeNone && !valid {
+			// expired value was left as-is
+			e.mu.Unlock()
+			return nil, ErrKeyNotFound
+		}
+		e.mu.Unlock()
+		return v, nil
+	}
+}
@@ -0,0 +1,31 @@
+package memoise
+
+// Incr - atomically add delta to the int64 counter stored under key
+// if the key isn't set, or has expired, a new counter is created. The TTL is reset on each call,
+// unless KeepTTL is passed, in which case the counter expires at the end of its original window
+func (c *valCache) Incr(key string, delta int64, opts ...EntryConfig) (int64, error) {
+	var err error
+	v, cErr := c.compute(key, func(it *citem, valid bool) (interface{}, computeOp) {
+		if !valid {
+			return delta, computeStore
+		}
+		n, ok := it.val.(int64)
+		if !ok {
+			err = ErrNotCounter
+			return nil, computeNone
+		}
+		return n + delta, computeStore
+	}, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if cErr != nil {
+		return 0, cErr
+	}
+	return v.(int64), nil
+}
+
+// Decr - atomically subtract delta from the counter, see Incr
+func (c *valCache) Decr(key string, delta int64, opts ...EntryConfig) (int64, error) {
+	return c.Incr(key, -delta, opts...)
+}
@@ -0,0 +1,67 @@
+package memoise
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// refreshEarly - XFetch: check whether the value should be refreshed ahead of expiry, caller must hold lock
+func (e *centry) refreshEarly(now time.Time) bool {
+	if e.beta <= 0 || e.item.expires.IsZero() {
+		return false
+	}
+	delta := float64(atomic.LoadInt64(&e.delta))
+	r := e.rnd.Float64()
+	if r == 0 {
+		return true
+	}
+	gap := time.Duration(-delta * e.beta * math.Log(r))
+	return !now.Add(gap).Before(e.item.expires)
+}
+
+// refreshAheadDue - check whether the value is past the refresh-ahead threshold, caller must hold lock
+func (e *centry) refreshAheadDue(now time.Time) bool {
+	if e.ahead <= 0 || e.item.err != nil || e.item.deadline.IsZero() || (e.rt != RefreshOnAccess && e.rt != RefreshAsync) {
+		// errors have their own TTL, and are refreshed once that has passed
+		return false
+	}
+	// expires slides with access, the deadline doesn't
+	left := e.item.deadline.Sub(now)
+	return left <= time.Duration(float64(e.item.ttl)*(1-e.ahead))
+}
+
+// refreshAhead - refresh a value in the background, without blocking concurrent reads
+// v and err are the cached values, returned if the entry is already being refreshed, or the call fails
+func (c *cache) refreshAhead(ctx context.Context, k string, e *centry, v interface{}, err error) (interface{}, error) {
+	if !atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+		return v, err
+	}
+	nv, nerr := e.call(ctx, v, err)
+	if nerr != nil && nerr != ErrNotModified {
+		// the cached value is still valid, keep it
+		e.mu.RLock()
+		c.manage(k, e)
+		e.mu.RUnlock()
+		atomic.StoreInt32(&e.refreshing, 0)
+		return v, err
+	}
+	e.mu.Lock()
+	old := e.item.val
+	nv, updated := e.update(nv, nerr)
+	if updated {
+		c.changed(k, old, nv, nerr, CauseRefresh)
+	}
+	// the janitor skips entries that are being refreshed
+	c.manage(k, e)
+	e.mu.Unlock()
+	atomic.StoreInt32(&e.refreshing, 0)
+	if updated {
+		c.invalidate(k)
+	}
+	if nerr == ErrNotModified {
+		nerr = nil
+	}
+	return nv, nerr
+}
@@ -0,0 +1,102 @@
+package memoise
+
+import (
+	"context"
+)
+
+// cacheCtx - passed on by Func, which has no context of its own, the cache context is used instead
+var cacheCtx = context.WithValue(context.Background(), cacheCtxKey{}, true)
+
+type cacheCtxKey struct{}
+
+// funcCache - caches that can load entries using a context-aware call
+type funcCache interface {
+	getOrLoad(ctx context.Context, key string, cb ctxCall, opts ...EntryConfig) (interface{}, error)
+}
+
+// Func - memoise fn, each distinct argument gets its own cache entry configured by opts
+// the key is name followed by a stable hash of the argument, so name should be unique per function
+func Func[A, R any](c Cache, name string, fn func(A) (R, error), opts ...EntryConfig) func(A) (R, error) {
+	m := memoFunc(c, name, func(_ context.Context, a A) (R, error) {
+		return fn(a)
+	}, opts...)
+	return func(a A) (R, error) {
+		return m(cacheCtx, a)
+	}
+}
+
+// FuncCtx - Func for functions taking a context, the context of the call that loads or refreshes
+// the entry is passed to fn
+func FuncCtx[A, R any](c Cache, name string, fn func(context.Context, A) (R, error), opts ...EntryConfig) func(context.Context, A) (R, error) {
+	return memoFunc(c, name, fn, opts...)
+}
+
+func memoFunc[A, R any](c Cache, name string, fn func(context.Context, A) (R, error), opts ...EntryConfig) func(context.Context, A) (R, error) {
+	return func(ctx context.Context, a A) (R, error) {
+		var zero R
+		key, err := argKey(name, a)
+		if err != nil {
+			return zero, err
+		}
+		cb := func(ctx context.Context) (interface{}, error) {
+			return fn(ctx, a)
+		}
+		var v interface{}
+		if fc, ok := c.(funcCache); ok {
+			v, err = fc.getOrLoad(ctx, key, cb, opts...)
+		} else {
+			v, err = getOrCAS(ctx, c, key, cb, opts...)
+		}
+		if r, ok := v.(R); ok {
+			return r, err
+		}
+		return zero, err
+	}
+}
+
+// getOrCAS - fallback for Cache implementations other than our own
+func getOrCAS(ctx context.Context, c Cache, key string, cb ctxCall, opts ...EntryConfig) (interface{}, error) {
+	v, err := c.GetCtx(ctx, key)
+	if err != ErrKeyNotFound {
+		return v, err
+	}
+	v, err = c.CAS(key, func() (interface{}, error) {
+		return cb(ctx)
+	}, opts...)
+	if err == ErrDuplicateEntry {
+		// someone else added the entry in the meantime
+		return c.GetCtx(ctx, key)
+	}
+	return v, err
+}
+
+// getOrLoad - get the value for key, adding an entry using cb if the key isn't cached
+func (c *cache) getOrLoad(ctx context.Context, key string, cb ctxCall, opts ...EntryConfig) (interface{}, error) {
+	if ctx == cacheCtx {
+		ctx = c.ctx
+	}
+	if !c.life.begin() {
+		return nil, ErrCacheClosed
+	}
+	c.mu.RLock()
+	ce, err := c.get(key)
+	c.mu.RUnlock()
+	if err == nil && ce.rt == NoRefresh {
+		// getCtx would use the cache loader to replace the expired entry
+		ce.mu.RLock()
+		exp := ce.item.expires
+		ce.mu.RUnlock()
+		if !exp.IsZero() && exp.Before(c.clock.Now()) {
+			c.unset(key, CauseExpired)
+			err = ErrKeyNotFound
+		}
+	}
+	var v interface{}
+	if err != nil {
+		v, err = c.load(ctx, key, cb, opts...)
+	} else {
+		v, err = c.getCtx(ctx, key)
+	}
+	c.life.end()
+	return v, err
+}
@@ -0,0 +1,217 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/EVODelavega/go-memoise"
+)
+
+const handlerPrefix = "httphandler:"
+
+// Response - a captured handler response
+// the fields are exported, and the type implements encoding.BinaryMarshaler, so it can be persisted
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// handler - middleware caching the responses of the wrapped handler
+type handler struct {
+	cache   memoise.Cache
+	next    http.Handler
+	headers []string
+	opts    []memoise.EntryConfig
+}
+
+// HandlerOption - configure the caching middleware
+type HandlerOption func(*handler)
+
+// Middleware - cache the complete responses (status, headers, body) of GET and HEAD requests
+// responses are keyed by method, host, path (including the query), and the headers set with VaryHeaders
+// all other requests are passed through. Responses setting cookies, or marked private or no-store
+// are not cached. Refreshes re-run the handler with a copy of the request that added the entry,
+// including its headers, so headers affecting the response should be added using VaryHeaders
+func Middleware(cache memoise.Cache, opts ...HandlerOption) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		h := &handler{
+			cache: cache,
+			next:  next,
+		}
+		for _, o := range opts {
+			o(h)
+		}
+		return h
+	}
+}
+
+// VaryHeaders - request headers that are part of the cache key, the host always is
+func VaryHeaders(names ...string) HandlerOption {
+	return func(h *handler) {
+		for _, n := range names {
+			h.headers = append(h.headers, http.CanonicalHeaderKey(n))
+		}
+		sort.Strings(h.headers)
+	}
+}
+
+// EntryOptions - entry configuration for the cached responses, e.g. TTL and refresh type
+// with RefreshAsync, stale responses are served while the handler runs in the background
+func EntryOptions(opts ...memoise.EntryConfig) HandlerOption {
+	return func(h *handler) {
+		h.opts = append(h.opts, opts...)
+	}
+}
+
+// ServeHTTP - implement http.Handler
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	key := h.key(r)
+	added := false
+	v, err := h.cache.GetCtx(r.Context(), key)
+	if err == memoise.ErrKeyNotFound {
+		v, err = h.cache.CAS(key, h.call(r), h.opts...)
+		added = err == nil
+		if err == memoise.ErrDuplicateEntry {
+			// added concurrently
+			v, _ = h.cache.GetCtx(r.Context(), key)
+		}
+	}
+	resp, ok := v.(*Response)
+	if ok && !resp.shared() {
+		h.cache.Unset(key)
+		// the response was made for the request adding the entry, no one else
+		ok = added
+	}
+	if !ok {
+		// cache closed, or nothing to serve
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	resp.write(w)
+}
+
+func (h *handler) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(handlerPrefix)
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	// net/http moves the Host header to r.Host, servers handling several hosts mustn't mix them up
+	b.WriteString(r.Host)
+	b.WriteString(r.URL.RequestURI())
+	for _, n := range h.headers {
+		b.WriteByte('\n')
+		b.WriteString(n)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(r.Header[n], ","))
+	}
+	return b.String()
+}
+
+// call - run the handler for (a copy of) the request, capturing the response
+// 5xx responses are returned as an error, so the cache type decides whether or not to keep them
+func (h *handler) call(r *http.Request) memoise.Call {
+	// the handler can be re-run in the background, long after the request is done
+	r = r.Clone(context.Background())
+	return func() (interface{}, error) {
+		rec := &recorder{
+			header: http.Header{},
+		}
+		h.next.ServeHTTP(rec, r.Clone(r.Context()))
+		resp := rec.response()
+		if resp.Status >= http.StatusInternalServerError {
+			return resp, &statusError{status: resp.Status}
+		}
+		return resp, nil
+	}
+}
+
+// shared - check whether the response can be served to other clients
+func (r *Response) shared() bool {
+	if len(r.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, cc := range r.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(cc, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "private" || d == "no-store" || strings.HasPrefix(d, "private=") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// write - write the captured response
+func (r *Response) write(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range r.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(r.Status)
+	_, _ = w.Write(r.Body)
+}
+
+// plainResponse - Response without the marshaler methods, so gob doesn't call them recursively
+type plainResponse Response
+
+// MarshalBinary - implement encoding.BinaryMarshaler
+func (r *Response) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode((*plainResponse)(r)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary - implement encoding.BinaryUnmarshaler
+func (r *Response) UnmarshalBinary(data []byte) error {
+	var p plainResponse
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return err
+	}
+	*r = Response(p)
+	return nil
+}
+
+// recorder - http.ResponseWriter capturing the response
+type recorder struct {
+	header      http.Header
+	resp        Response
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.resp.Status = status
+	// changes made after the header is written are ignored
+	r.resp.Header = r.header.Clone()
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *recorder) response() *Response {
+	r.WriteHeader(http.StatusOK)
+	resp := r.resp
+	resp.Body = r.body.Bytes()
+	return &resp
+}
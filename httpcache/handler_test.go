@@ -0,0 +1,126 @@
+package httpcache_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EVODelavega/go-memoise"
+	"github.com/EVODelavega/go-memoise/clocktest"
+	"github.com/EVODelavega/go-memoise/httpcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func serve(h http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddleware(t *testing.T) {
+	var runs int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&runs, 1)
+		w.Header().Set("X-Run", fmt.Sprint(n))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, r.Header.Get("Accept-Language"))
+	})
+	h := httpcache.Middleware(memoise.New(), httpcache.VaryHeaders("accept-language"))(next)
+	en := http.Header{"Accept-Language": {"en"}}
+	for i := 0; i < 3; i++ {
+		rec := serve(h, http.MethodGet, "/foo?bar=1", en)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("X-Run"))
+		assert.Equal(t, "en", rec.Body.String())
+	}
+	// configured headers, method, host, and path are part of the key
+	rec := serve(h, http.MethodGet, "/foo?bar=1", http.Header{"Accept-Language": {"nl"}})
+	assert.Equal(t, "nl", rec.Body.String())
+	_ = serve(h, http.MethodHead, "/foo?bar=1", en)
+	_ = serve(h, http.MethodGet, "/foo", en)
+	rec = serve(h, http.MethodGet, "http://other.example/foo?bar=1", en)
+	assert.Equal(t, "5", rec.Header().Get("X-Run"))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&runs))
+	// other methods are not cached
+	_ = serve(h, http.MethodPost, "/foo?bar=1", en)
+	_ = serve(h, http.MethodPost, "/foo?bar=1", en)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&runs))
+}
+
+func TestMiddlewarePrivate(t *testing.T) {
+	var runs int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&runs, 1)
+		switch r.URL.Path {
+		case "/login":
+			w.Header().Set("Set-Cookie", fmt.Sprintf("session=%d", n))
+		case "/me":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/secret":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		_, _ = io.WriteString(w, fmt.Sprint(n))
+	})
+	h := httpcache.Middleware(memoise.New())(next)
+	for _, path := range []string{"/login", "/me", "/secret"} {
+		first := serve(h, http.MethodGet, path, nil)
+		second := serve(h, http.MethodGet, path, nil)
+		assert.NotEqual(t, first.Body.String(), second.Body.String(), path)
+	}
+	assert.Equal(t, "session=7", serve(h, http.MethodGet, "/login", nil).Header().Get("Set-Cookie"))
+	assert.Equal(t, int32(7), atomic.LoadInt32(&runs))
+}
+
+func TestMiddlewareRefreshAsync(t *testing.T) {
+	var runs int32
+	started, release := make(chan struct{}), make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&runs, 1)
+		if n > 1 {
+			close(started)
+			<-release
+		}
+		_, _ = fmt.Fprint(w, n)
+	})
+	clock := clocktest.New(time.Now())
+	h := httpcache.Middleware(
+		memoise.New(memoise.WithClock(clock)),
+		httpcache.EntryOptions(memoise.SetTTL(time.Minute), memoise.SetRefreshType(memoise.RefreshAsync)),
+	)(next)
+	assert.Equal(t, "1", serve(h, http.MethodGet, "/", nil).Body.String())
+	// the janitor re-runs the handler once the response expires
+	go clock.Advance(time.Minute)
+	<-started
+	// stale response is served in the mean time
+	assert.Equal(t, "1", serve(h, http.MethodGet, "/", nil).Body.String())
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && serve(h, http.MethodGet, "/", nil).Body.String() != "2" {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, "2", serve(h, http.MethodGet, "/", nil).Body.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&runs))
+}
+
+func TestResponseMarshal(t *testing.T) {
+	resp := &httpcache.Response{
+		Status: http.StatusOK,
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Body:   []byte("hello"),
+	}
+	data, err := resp.MarshalBinary()
+	assert.NoError(t, err)
+	got := &httpcache.Response{}
+	assert.NoError(t, got.UnmarshalBinary(data))
+	assert.Equal(t, resp, got)
+	assert.Error(t, got.UnmarshalBinary([]byte(strings.Repeat("x", 4))))
+}
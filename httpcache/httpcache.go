@@ -0,0 +1,267 @@
+// Package httpcache provides an http.RoundTripper caching GET responses in a memoise.Cache
+//
+// Freshness is determined by the Cache-Control max-age directive, or the Expires header. Stale
+// responses are revalidated using the ETag of the cached response. Should the upstream fail
+// (transport error or 5xx status), the stale response is returned with a Warning header.
+// Responses carrying a Vary header are not cached, nor shared with concurrent requests. Requests carrying credentials (Authorization or
+// Cookie headers) are cached separately for each set of credentials. Fetches and revalidations
+// use the headers and context of the request that triggers them.
+//
+// The package also provides Middleware, caching complete responses of an http.Handler.
+package httpcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EVODelavega/go-memoise"
+)
+
+const (
+	keyPrefix = "httpcache:"
+	// staleWarning - warning header added to stale responses returned because of upstream errors
+	staleWarning = `110 - "Response is Stale"`
+	// DefaultMaxIdle - default time responses are kept without being requested
+	DefaultMaxIdle = 10 * time.Minute
+)
+
+// requestKey - context key for the request triggering a call
+type requestKey struct{}
+
+// Transport - caching http.RoundTripper
+type Transport struct {
+	cache      memoise.Cache
+	next       http.RoundTripper
+	defaultTTL time.Duration
+	maxIdle    time.Duration
+	now        func() time.Time
+	mu         *sync.Mutex
+	pending    map[string]chan struct{} // keys being added, closed once added
+}
+
+// Option - configure the transport
+type Option func(*Transport)
+
+// New - create a transport caching responses in cache
+func New(cache memoise.Cache, opts ...Option) *Transport {
+	t := &Transport{
+		cache:   cache,
+		next:    http.DefaultTransport,
+		maxIdle: DefaultMaxIdle,
+		now:     time.Now,
+		mu:      &sync.Mutex{},
+		pending: map[string]chan struct{}{},
+	}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
+}
+
+// WithTransport - transport used to make the actual requests, defaults to http.DefaultTransport
+func WithTransport(rt http.RoundTripper) Option {
+	return func(t *Transport) {
+		t.next = rt
+	}
+}
+
+// DefaultTTL - freshness of responses that don't specify max-age or Expires
+// default is 0, meaning those responses are revalidated on every request
+func DefaultTTL(d time.Duration) Option {
+	return func(t *Transport) {
+		t.defaultTTL = d
+	}
+}
+
+// MaxIdle - responses that aren't requested for this long are removed from the cache, stale or not
+// this bounds the number of responses kept, as each distinct URL gets its own entry
+func MaxIdle(d time.Duration) Option {
+	return func(t *Transport) {
+		t.maxIdle = d
+	}
+}
+
+// WithClock - clock used to determine freshness, mainly for testing
+func WithClock(c memoise.Clock) Option {
+	return func(t *Transport) {
+		t.now = c.Now
+	}
+}
+
+// RoundTrip - implement http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	// calls take the request from the context, so they use its headers and context
+	ctx := context.WithValue(req.Context(), requestKey{}, req)
+	v, err := t.cache.GetCtx(ctx, key)
+	if err == memoise.ErrKeyNotFound {
+		v, err = t.add(ctx, key, req)
+	}
+	if err == memoise.ErrCacheClosed {
+		return t.next.RoundTrip(req)
+	}
+	if r, ok := v.(*response); ok && err == nil && !r.fresh(t.now()) {
+		v, err = t.cache.RefreshCtx(ctx, key)
+		if err == memoise.ErrKeyNotFound {
+			// removed in the mean time
+			v, err = t.add(ctx, key, req)
+		}
+	}
+	r, ok := v.(*response)
+	if !ok {
+		if se, ok := err.(*statusError); ok {
+			if se.resp.req != req {
+				// error responses aren't shared with concurrent requests
+				return t.next.RoundTrip(req)
+			}
+			// nothing stale to return, pass on the upstream response
+			t.cache.Unset(key)
+			return se.resp.httpResponse(req), nil
+		}
+		if err == nil {
+			// the entry was replaced by something other than a response
+			return t.next.RoundTrip(req)
+		}
+		return nil, err
+	}
+	if !r.store {
+		if r.req != req {
+			// fetched for a concurrent request, but it can't be shared
+			return t.next.RoundTrip(req)
+		}
+		t.cache.Unset(key)
+	}
+	resp := r.httpResponse(req)
+	if err != nil {
+		resp.Header.Add("Warning", staleWarning)
+	}
+	return resp, nil
+}
+
+// add - add the entry for key, concurrent requests for the same key wait for the first one
+func (t *Transport) add(ctx context.Context, key string, req *http.Request) (interface{}, error) {
+	t.mu.Lock()
+	if ch, ok := t.pending[key]; ok {
+		t.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v, err := t.cache.GetCtx(ctx, key)
+		if err == memoise.ErrKeyNotFound {
+			// the response couldn't be stored, or the entry has been removed already
+			return t.add(ctx, key, req)
+		}
+		return v, err
+	}
+	ch := make(chan struct{})
+	t.pending[key] = ch
+	t.mu.Unlock()
+	// could have been added before we took the lock
+	v, err := t.cache.GetCtx(ctx, key)
+	if err == memoise.ErrKeyNotFound {
+		v, err = t.cache.SetRefreshCall(
+			key,
+			t.call(req),
+			// freshness is checked here, the entry is refreshed when a stale response is requested
+			// and removed once it hasn't been requested for a while
+			memoise.SetTTL(memoise.ValueExpiryNever),
+			memoise.ExpireAfterAccess(t.maxIdle),
+			memoise.SetRefreshType(memoise.NoRefresh),
+			memoise.SetCacheType(memoise.CacheValueReturnStaleOnError),
+		)
+		if err == memoise.ErrDuplicateEntry {
+			// added by someone else sharing the cache
+			v, err = t.cache.GetCtx(ctx, key)
+		}
+	}
+	t.mu.Lock()
+	delete(t.pending, key)
+	t.mu.Unlock()
+	close(ch)
+	return v, err
+}
+
+// cacheKey - key for the request, credentials are hashed into the key so responses aren't shared between users
+func cacheKey(req *http.Request) string {
+	key := keyPrefix + req.URL.String()
+	auth, cookies := req.Header.Values("Authorization"), req.Header.Values("Cookie")
+	if len(auth) == 0 && len(cookies) == 0 {
+		return key
+	}
+	h := sha256.New()
+	for _, vals := range [][]string{auth, cookies} {
+		for _, v := range vals {
+			_, _ = io.WriteString(h, v)
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	return key + "#" + hex.EncodeToString(h.Sum(nil))
+}
+
+// call - the call fetching the response for the entry, revalidating the previous response if possible
+// the request is taken from the context passed to GetCtx or RefreshCtx. The request adding the
+// entry is used for the initial call, which is made using the cache context
+func (t *Transport) call(initial *http.Request) memoise.RefreshCall {
+	first := &atomic.Pointer[http.Request]{}
+	first.Store(initial)
+	return func(ctx context.Context, prev interface{}, _ error) (interface{}, error) {
+		req, ok := ctx.Value(requestKey{}).(*http.Request)
+		if f := first.Swap(nil); !ok {
+			req = f
+		}
+		if req == nil {
+			// not triggered by a request, leave it to the next one
+			return nil, memoise.ErrNotModified
+		}
+		now := t.now()
+		last, _ := prev.(*response)
+		if last != nil && last.fresh(now) {
+			// revalidated while we were waiting on the entry
+			return nil, memoise.ErrNotModified
+		}
+		r := req.Clone(req.Context())
+		if last != nil && last.etag != "" {
+			r.Header.Set("If-None-Match", last.etag)
+		}
+		resp, err := t.next.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var nr *response
+		if resp.StatusCode == http.StatusNotModified && last != nil {
+			// keep the body, update headers and freshness
+			h := last.header.Clone()
+			for k, v := range resp.Header {
+				h[k] = v
+			}
+			nr = t.newResponse(last.status, h, last.body, now)
+		} else {
+			nr = t.newResponse(resp.StatusCode, resp.Header, body, now)
+		}
+		if !nr.store {
+			// only the request it was fetched for gets the response, see RoundTrip
+			nr.req = req
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return nil, &statusError{status: resp.StatusCode, resp: nr}
+		}
+		return nr, nil
+	}
+}
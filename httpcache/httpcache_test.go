@@ -0,0 +1,314 @@
+package httpcache_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EVODelavega/go-memoise"
+	"github.com/EVODelavega/go-memoise/clocktest"
+	"github.com/EVODelavega/go-memoise/httpcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	resp, err := client.Get(url)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestMaxAgeRevalidate(t *testing.T) {
+	var hits, notModified, fail int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	clock := clocktest.New(time.Now())
+	client := &http.Client{
+		Transport: httpcache.New(memoise.New(), httpcache.WithClock(clock)),
+	}
+	for i := 0; i < 3; i++ {
+		resp, body := get(t, client, srv.URL)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", body)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	// stale, revalidated using the ETag
+	clock.Advance(time.Minute)
+	resp, body := get(t, client, srv.URL)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+	// fresh again
+	_, _ = get(t, client, srv.URL)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	// upstream errors: serve stale
+	atomic.StoreInt32(&fail, 1)
+	clock.Advance(time.Minute)
+	resp, body = get(t, client, srv.URL)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.NotEmpty(t, resp.Header.Get("Warning"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+}
+
+func TestExpires(t *testing.T) {
+	var hits int32
+	clock := clocktest.New(time.Now())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		now := clock.Now()
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		w.Header().Set("Expires", now.Add(10*time.Second).UTC().Format(http.TimeFormat))
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	client := &http.Client{
+		Transport: httpcache.New(memoise.New(), httpcache.WithClock(clock)),
+	}
+	_, _ = get(t, client, srv.URL)
+	_, _ = get(t, client, srv.URL)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	clock.Advance(11 * time.Second)
+	_, body := get(t, client, srv.URL)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestNotCached(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store, max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	client := &http.Client{
+		Transport: httpcache.New(memoise.New()),
+	}
+	_, _ = get(t, client, srv.URL)
+	_, _ = get(t, client, srv.URL)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	// other methods are passed through
+	resp, err := client.Post(srv.URL, "text/plain", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	// errors without a stale response are returned as-is
+	resp, _ = get(t, client, srv.URL+"/error")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+// missCache - makes the first misses wait for each other, so they add the entry concurrently
+type missCache struct {
+	memoise.Cache
+	misses *sync.WaitGroup
+	count  int32
+}
+
+func (c *missCache) GetCtx(ctx context.Context, key string) (interface{}, error) {
+	v, err := c.Cache.GetCtx(ctx, key)
+	if err == memoise.ErrKeyNotFound && atomic.AddInt32(&c.count, 1) <= 2 {
+		c.misses.Done()
+		c.misses.Wait()
+	}
+	return v, err
+}
+
+func TestConcurrentMiss(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	cache := &missCache{
+		Cache:  memoise.New(),
+		misses: &sync.WaitGroup{},
+	}
+	cache.misses.Add(2)
+	client := &http.Client{
+		Transport: httpcache.New(cache),
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			resp, err := client.Get(srv.URL)
+			if assert.NoError(t, err) {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, "hello", string(body))
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestConcurrentVary(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+	defer srv.Close()
+	cache := &missCache{
+		Cache:  memoise.New(),
+		misses: &sync.WaitGroup{},
+	}
+	cache.misses.Add(2)
+	client := &http.Client{
+		Transport: httpcache.New(cache),
+	}
+	wg := &sync.WaitGroup{}
+	for _, lang := range []string{"en", "nl"} {
+		wg.Add(1)
+		go func(lang string) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			assert.NoError(t, err)
+			req.Header.Set("Accept-Language", lang)
+			resp, err := client.Do(req)
+			if assert.NoError(t, err) {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				// responses that can't be stored aren't shared with waiting requests
+				assert.Equal(t, lang, string(body))
+			}
+			wg.Done()
+		}(lang)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	assert.Empty(t, cache.Stats().Keys)
+}
+
+func TestCredentials(t *testing.T) {
+	var hits int32
+	auths := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		auths <- r.Header.Get("Authorization") + r.Header.Get("X-Trace")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"`+r.Header.Get("Authorization")+`"`)
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("hello " + r.Header.Get("Authorization")))
+	}))
+	defer srv.Close()
+	clock := clocktest.New(time.Now())
+	client := &http.Client{
+		Transport: httpcache.New(memoise.New(), httpcache.WithClock(clock)),
+	}
+	getAs := func(user string) string {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", user)
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+	// responses aren't shared between users
+	assert.Equal(t, "hello alice", getAs("alice"))
+	assert.Equal(t, "hello bob", getAs("bob"))
+	assert.Equal(t, "hello alice", getAs("alice"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	assert.Equal(t, "alice", <-auths)
+	assert.Equal(t, "bob", <-auths)
+	// revalidation uses the headers of the current request
+	clock.Advance(time.Minute)
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "bob")
+	req.Header.Set("X-Trace", "second")
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "bobsecond", <-auths)
+}
+
+func TestRequestContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer srv.Close()
+	defer close(release)
+	client := &http.Client{
+		Transport: httpcache.New(memoise.New()),
+		Timeout:   50 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err := client.Get(srv.URL)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestMaxIdle(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(memoise.WithClock(clock))
+	client := &http.Client{
+		Transport: httpcache.New(cache, httpcache.WithClock(clock), httpcache.MaxIdle(time.Minute)),
+	}
+	for i := 0; i < 3; i++ {
+		_, _ = get(t, client, srv.URL+"/a")
+		_, _ = get(t, client, srv.URL+"/b")
+		clock.Advance(40 * time.Second)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	assert.Len(t, cache.Stats().Keys, 2)
+	// b isn't requested anymore, and is removed
+	_, _ = get(t, client, srv.URL+"/a")
+	clock.Advance(40 * time.Second)
+	assert.Len(t, cache.Stats().Keys, 1)
+	_, _ = get(t, client, srv.URL+"/b")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+}
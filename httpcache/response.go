@@ -0,0 +1,109 @@
+package httpcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheableStatus - status codes that can be cached
+var cacheableStatus = map[int]struct{}{
+	http.StatusOK:                   {},
+	http.StatusNonAuthoritativeInfo: {},
+	http.StatusNoContent:            {},
+	http.StatusMultipleChoices:      {},
+	http.StatusMovedPermanently:     {},
+	http.StatusNotFound:             {},
+	http.StatusGone:                 {},
+}
+
+// response - cached response, never modified once created
+type response struct {
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+	store   bool
+	req     *http.Request // request the response was fetched for, only set if it can't be stored
+}
+
+// statusError - error for 5xx responses, so stale responses are returned instead
+type statusError struct {
+	status int
+	resp   *response
+}
+
+func (s *statusError) Error() string {
+	return "upstream responded with status " + strconv.Itoa(s.status)
+}
+
+// newResponse - create a response, determining its freshness from the headers
+func (t *Transport) newResponse(status int, h http.Header, body []byte, now time.Time) *response {
+	r := &response{
+		status: status,
+		header: h,
+		body:   body,
+		etag:   h.Get("ETag"),
+	}
+	_, r.store = cacheableStatus[status]
+	if h.Get("Vary") != "" {
+		r.store = false
+	}
+	ttl, ok := t.defaultTTL, false
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-store":
+			r.store = false
+		case d == "no-cache":
+			ttl, ok = 0, true
+		case strings.HasPrefix(d, "max-age=") && !ok:
+			if s, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil {
+				ttl, ok = time.Duration(s)*time.Second, true
+			}
+		}
+	}
+	if !ok {
+		if exp, err := http.ParseTime(h.Get("Expires")); err == nil {
+			// use Date as reference, if present, to avoid issues with clock skew
+			date, err := http.ParseTime(h.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			ttl, ok = exp.Sub(date), true
+		} else if h.Get("Expires") != "" {
+			// invalid dates (e.g. "0") mean the response has already expired
+			ttl, ok = 0, true
+		}
+	}
+	if ok {
+		if age, err := strconv.Atoi(h.Get("Age")); err == nil {
+			ttl -= time.Duration(age) * time.Second
+		}
+	}
+	r.expires = now.Add(ttl)
+	return r
+}
+
+func (r *response) fresh(now time.Time) bool {
+	return now.Before(r.expires)
+}
+
+// httpResponse - create a new http.Response from the cached data
+func (r *response) httpResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(r.status) + " " + http.StatusText(r.status),
+		StatusCode:    r.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+		Request:       req,
+	}
+}
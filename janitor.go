@@ -1,112 +1,236 @@
 package memoise
 
 import (
+	"container/heap"
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// janitor - refreshes (RefreshAsync) or removes (NoRefresh) entries once they expire
+// entries are kept in a min-heap ordered by expiry, a single timer is set to fire when the first one is due
 type janitor struct {
-	cfunc       context.CancelFunc  // this is so we can control the janitor without messing with cache
-	c           *cache              // cache to work with, obviously
-	cycle       time.Duration       // interval at which we want the janitor to kick in
-	managedKeys map[string]struct{} // list of keys to manage, use map for easier lookups
-	dch         chan string         // channel used to notify janitor to ignore a certain key
-	sch         chan string         // channel used to notify janitor of another key to manage
-}
-
-func newJanitor(ctx context.Context, c *cache, cycle time.Duration) *janitor {
-	// channels buffer to 1 -> so they're not blocking, but the risk of having a key be invalidated
-	// and re-added & stuff like that should be reduced, hence don't increase buffers
-	// without thinking this through, especially not the dch buffer
+	mu      *sync.Mutex
+	c       *cache              // cache to work with, obviously
+	cycle   time.Duration       // interval at which failed refreshes are tried again
+	queue   schedule            // heap of scheduled entries
+	items   map[string]*jobItem // scheduled entries by key, each key is scheduled once at most
+	timer   Timer
+	next    time.Time // time at which the timer fires, zero if timer isn't set
+	stopped bool
+}
+
+type jobItem struct {
+	key     string
+	e       *centry
+	at      time.Time
+	attempt int // number of the retry, 0 for regular refreshes
+	idx     int // index in heap
+}
+
+// schedule - implements heap.Interface
+type schedule []*jobItem
+
+func newJanitor(c *cache, cycle time.Duration) *janitor {
 	return &janitor{
+		mu:    &sync.Mutex{},
 		c:     c,
 		cycle: cycle,
-		dch:   make(chan string, 1),
-		sch:   make(chan string, 1),
+		items: map[string]*jobItem{},
 	}
 }
 
+// start - stop the janitor once the context is cancelled
 func (j *janitor) start(ctx context.Context) {
-	// already started
-	if j.cfunc != nil {
+	<-ctx.Done()
+	j.stop()
+}
+
+// stop - stop the timer and drop all scheduled entries
+func (j *janitor) stop() {
+	j.mu.Lock()
+	j.stopped = true
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	j.queue = nil
+	j.items = map[string]*jobItem{}
+	j.mu.Unlock()
+}
+
+// schedule - (re)schedule the given key, replacing whatever was scheduled for the key
+func (j *janitor) schedule(k string, e *centry, at time.Time) {
+	j.scheduleRetry(k, e, at, 0)
+}
+
+func (j *janitor) scheduleRetry(k string, e *centry, at time.Time, attempt int) {
+	j.mu.Lock()
+	if j.stopped {
+		j.mu.Unlock()
 		return
 	}
-	ctx, j.cfunc = context.WithCancel(ctx)
-	tick := time.NewTimer(j.cycle)
-	for {
-		select {
-		case <-ctx.Done():
-			close(j.dch)
-			close(j.sch)
-			tick.Stop()
-			return
-		case k := <-j.sch:
-			j.managedKeys[k] = struct{}{}
-		case k := <-j.dch:
-			if _, ok := j.managedKeys[k]; ok {
-				delete(j.managedKeys, k)
-			}
-		case now := <-tick.C:
-			// we don't want to risk a race condition while we're doing maintenance, the channels might be full
-			drainCtx, cfunc := context.WithCancel(ctx)
-			// this ensures the sch and dch don't cause deadlocks
-			// use channel to reassign map within the same routine, too
-			mch := make(chan map[string]struct{}, 1)
-			j.chanDrain(drainCtx, mch)
-			for k := range j.managedKeys {
-				// quickly lock, get value && unlock
-				j.c.mu.RLock()
-				e, ok := j.c.entries[k]
-				j.c.mu.RUnlock()
-				if !ok {
-					// key doesn't exist anymore, remove from managed key set
-					j.dch <- k
-					continue
-				}
-				e.mu.Lock()
-				// this func messes around with the entry, so acquire lock
-				j.refreshItem(e, now, k)
-				e.mu.Unlock()
-			}
-			cfunc() // and cancel the chanDrain routine
-			j.managedKeys = <-mch
-			close(mch)
+	if it, ok := j.items[k]; ok {
+		it.e, it.at, it.attempt = e, at, attempt
+		heap.Fix(&j.queue, it.idx)
+	} else {
+		it = &jobItem{
+			key:     k,
+			e:       e,
+			at:      at,
+			attempt: attempt,
 		}
+		j.items[k] = it
+		heap.Push(&j.queue, it)
 	}
+	j.arm()
+	j.mu.Unlock()
 }
 
-func (j *janitor) chanDrain(ctx context.Context, ch chan<- map[string]struct{}) {
-	mapCpy := map[string]struct{}{}
-	// create a copy of the managedKeys map, avoiding race conditions
-	for k, s := range j.managedKeys {
-		mapCpy[k] = s
-	}
-	// keep consuming channels, update copy of map used in start routine
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				// now the management has completed, we can reassign the updated map
-				ch <- mapCpy
-				return
-			case k := <-j.dch:
-				delete(mapCpy, k)
-			case k := <-j.sch:
-				mapCpy[k] = struct{}{}
-			}
+// unschedule - stop managing the given key
+func (j *janitor) unschedule(k string) {
+	j.mu.Lock()
+	if it, ok := j.items[k]; ok {
+		heap.Remove(&j.queue, it.idx)
+		delete(j.items, k)
+	}
+	// if this was the first item, the timer firing early is harmless
+	j.mu.Unlock()
+}
+
+// arm - make sure the timer fires when the first item is due, caller must hold lock
+func (j *janitor) arm() {
+	if len(j.queue) == 0 || j.stopped {
+		return
+	}
+	at := j.queue[0].at
+	if !j.next.IsZero() && !at.Before(j.next) {
+		// timer will fire soon enough
+		return
+	}
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	j.next = at
+	j.timer = j.c.clock.AfterFunc(at.Sub(j.c.clock.Now()), j.run)
+}
+
+// run - handle all entries that are due
+func (j *janitor) run() {
+	j.mu.Lock()
+	j.next = time.Time{}
+	now := j.c.clock.Now()
+	due := []*jobItem{}
+	for len(j.queue) > 0 && !j.queue[0].at.After(now) {
+		it := heap.Pop(&j.queue).(*jobItem)
+		delete(j.items, it.key)
+		due = append(due, it)
+	}
+	j.arm()
+	j.mu.Unlock()
+	for _, it := range due {
+		if !j.c.life.begin() {
+			return
 		}
-	}()
+		j.handle(it, now)
+		j.c.life.end()
+	}
 }
 
-func (j *janitor) refreshItem(e *centry, now time.Time, k string) {
-	if e.item.expires.After(now) {
+// handle - refresh or remove an entry that is due
+func (j *janitor) handle(it *jobItem, now time.Time) {
+	k, e := it.key, it.e
+	j.c.mu.RLock()
+	cur, ok := j.c.entries[k]
+	j.c.mu.RUnlock()
+	if !ok || cur != e {
+		// key was unset, or set again (and scheduled again if needs be)
 		return
 	}
-	if e.rt == NoRefresh {
-		j.dch <- k
+	e.mu.RLock()
+	exp, deadline, prev, prevErr := e.item.expires, e.item.deadline, e.item.val, e.item.err
+	e.mu.RUnlock()
+	if exp.IsZero() {
 		return
 	}
-	v, err := e.cb()
-	// refresh in cache, we have locked the item
-	j.c.autoRefresh(k, v, err)
+	if exp.After(now) && it.attempt == 0 {
+		// refreshed or extended in the mean time
+		j.schedule(k, e, exp)
+		return
+	}
+	if e.rt == NoRefresh || (e.idle > 0 && (deadline.IsZero() || exp.Before(deadline))) {
+		// expired, or idle for too long: nobody needs the value, don't refresh it
+		j.c.unset(k, CauseExpired)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+		// being refreshed ahead of expiry as we speak, entry will be rescheduled once done
+		return
+	}
+	if it.attempt > 0 {
+		atomic.AddUint64(&e.retries, 1)
+	}
+	// make the call without holding the lock, so reads aren't blocked
+	v, err := e.invoke(j.c.ctx, prev, prevErr)
+	e.mu.Lock()
+	old, accessed := e.item.val, e.item.accessed
+	refreshed := j.c.autoRefresh(e, v, err)
+	if refreshed && !accessed.IsZero() {
+		// refreshing isn't access, the entry still expires once it's idle
+		e.item.touch(accessed, e.idle)
+	}
+	exp, v = e.item.expires, e.item.val
+	if refreshed {
+		j.c.changed(k, old, v, err, CauseAutoRefresh)
+	}
+	e.mu.Unlock()
+	atomic.StoreInt32(&e.refreshing, 0)
+	if refreshed {
+		j.c.invalidate(k)
+	}
+	if err == ErrNotModified {
+		err = nil
+	}
+	if err != nil && err != ErrCircuitOpen && it.attempt+1 < e.retry.attempts {
+		// don't hold up the janitor, retry in the background
+		j.scheduleRetry(k, e, j.c.clock.Now().Add(e.retry.backoff(it.attempt+1, e.rnd)), it.attempt+1)
+		return
+	}
+	if exp.IsZero() {
+		return
+	}
+	if now = j.c.clock.Now(); !exp.After(now) {
+		// refresh failed, try again later
+		exp = now.Add(j.cycle)
+	}
+	j.schedule(k, e, exp)
+}
+
+func (s schedule) Len() int {
+	return len(s)
+}
+
+func (s schedule) Less(i, j int) bool {
+	return s[i].at.Before(s[j].at)
+}
+
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].idx = i
+	s[j].idx = j
+}
+
+func (s *schedule) Push(x interface{}) {
+	it := x.(*jobItem)
+	it.idx = len(*s)
+	*s = append(*s, it)
+}
+
+func (s *schedule) Pop() interface{} {
+	old := *s
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	*s = old[:n-1]
+	return it
 }
@@ -0,0 +1,38 @@
+package memoise
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedRand - rand.Rand is not safe for concurrent use
+type lockedRand struct {
+	mu *sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	return &lockedRand{
+		mu: &sync.Mutex{},
+		r:  rand.New(src),
+	}
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	f := l.r.Float64()
+	l.mu.Unlock()
+	return f
+}
+
+// jitterTTL - reduce ttl by a random fraction, at most by the given fraction of the ttl
+func jitterTTL(ttl time.Duration, fraction float64, rnd *lockedRand) time.Duration {
+	if fraction <= 0 || ttl <= 0 {
+		return ttl
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return ttl - time.Duration(float64(ttl)*fraction*rnd.Float64())
+}
@@ -0,0 +1,88 @@
+package memoise
+
+import (
+	"context"
+	"sync"
+)
+
+// lifecycle - keeps track of in-flight operations, so the cache can be shut down gracefully
+type lifecycle struct {
+	mu     *sync.RWMutex
+	wg     *sync.WaitGroup
+	closed bool
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		mu: &sync.RWMutex{},
+		wg: &sync.WaitGroup{},
+	}
+}
+
+// begin - register an operation, returns false if the cache is closed
+func (l *lifecycle) begin() bool {
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return false
+	}
+	l.wg.Add(1)
+	l.mu.RUnlock()
+	return true
+}
+
+// end - mark operation registered by begin as done
+func (l *lifecycle) end() {
+	l.wg.Done()
+}
+
+func (l *lifecycle) isClosed() bool {
+	l.mu.RLock()
+	closed := l.closed
+	l.mu.RUnlock()
+	return closed
+}
+
+// close - stop accepting new operations, returns false if already closed
+func (l *lifecycle) close() bool {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return false
+	}
+	l.closed = true
+	l.mu.Unlock()
+	return true
+}
+
+// Close - close the cache right away, stopping background work and cancelling running calls
+func (c *cache) Close() error {
+	if !c.life.close() {
+		return ErrCacheClosed
+	}
+	c.j.stop()
+	c.cancel()
+	return nil
+}
+
+// Shutdown - close the cache, stop background work, and wait for in-flight calls to return
+// if the context is done before that, running calls are cancelled and the context error is returned
+func (c *cache) Shutdown(ctx context.Context) error {
+	if !c.life.close() {
+		return ErrCacheClosed
+	}
+	c.j.stop()
+	done := make(chan struct{})
+	go func() {
+		c.life.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		c.cancel()
+		return nil
+	case <-ctx.Done():
+		c.cancel()
+		return ctx.Err()
+	}
+}
@@ -2,42 +2,85 @@ package memoise
 
 import (
 	"context"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type citem struct {
-	val     interface{}
-	err     error
-	expires time.Time
+	val      interface{}
+	err      error
+	expires  time.Time
+	deadline time.Time     // expiry based on write time, expires can't be pushed past this by access
+	accessed time.Time     // last access, only tracked for entries that expire after access
+	version  uint64        // changes whenever val is set
+	ttl      time.Duration // TTL applied when written, jitter included
 }
 
 type centry struct {
-	item *citem
-	mu   *sync.RWMutex // mutex at entry level -> used to refresh cache
-	cb   Call
-	ct   CacheType
-	rt   RefreshType
-	ttl  time.Duration
+	item   *citem
+	mu     *sync.RWMutex // mutex at entry level -> used to refresh cache
+	cb     ctxCall
+	rcb    RefreshCall // used instead of cb, if set
+	ct     CacheType
+	rt     RefreshType
+	ttl    time.Duration
+	errTTL time.Duration // TTL for errors not cached as values, 0 uses cache type behaviour
+	deps   []string      // keys this entry is derived from
+	retry  retryPolicy
+	br     *breaker // nil if no circuit breaker is used
+	jitter float64  // fraction by which TTL is randomly reduced
+	rnd    *lockedRand
+	clock  Clock
+	beta   float64       // early refresh factor, 0 disables early refresh
+	ahead  float64       // fraction of TTL after which values are refreshed in the background
+	idle   time.Duration // expire after access, 0 disables
+	maxAge time.Duration // max staleness of values served after expiry, 0 for no limit
+	// use atomic
+	delta      int64 // duration of the last call, in ns
+	refreshing int32 // 1 while refreshing ahead of expiry
+	// stats, use atomic
+	attempts uint64
+	retries  uint64
+	tooStale uint64
 }
 
 type vcentry struct {
-	item *citem
-	mu   *sync.RWMutex
-	ttl  time.Duration
+	item    *citem
+	mu      *sync.RWMutex
+	ttl     time.Duration
+	jitter  float64
+	rnd     *lockedRand
+	keepTTL bool
+	idle    time.Duration
+	removed bool // entry was removed from the cache, while waiting for the lock
 }
 
 type cache struct {
-	mu              *sync.RWMutex      // duh, we need mutex because... see below
-	entries         map[string]*centry // let's not use sync.Map, it's crap anyway
+	mu              *sync.RWMutex                  // duh, we need mutex because... see below
+	entries         map[string]*centry             // let's not use sync.Map, it's crap anyway
+	deps            map[string]map[string]struct{} // key -> keys depending on it
 	vCache          *valCache
 	defaultCT       CacheType
 	defaultRT       RefreshType
 	defaultTTL      time.Duration
+	defaultErrTTL   time.Duration
+	defaultRetry    retryPolicy
+	defaultBreaker  breakerConf
+	defaultJitter   float64
+	rnd             *lockedRand
+	clock           Clock
 	checkDuplicates DuplicateCheck
 	jCycle          time.Duration
+	batch           *batcher
+	loader          Loader
+	bWindow         time.Duration
 	ctx             context.Context
+	cancel          context.CancelFunc
+	life            *lifecycle
 	j               *janitor
+	w               *watchers
 }
 
 // cache for values
@@ -45,7 +88,11 @@ type valCache struct {
 	mu              *sync.RWMutex
 	entries         map[string]*vcentry
 	defaultTTL      time.Duration
+	defaultJitter   float64
 	checkDuplicates DuplicateCheck
+	rnd             *lockedRand
+	clock           Clock
+	life            *lifecycle
 }
 
 // default cache setup
@@ -54,21 +101,34 @@ func newCache() *cache {
 }
 
 func newCacheCtx(ctx context.Context) *cache {
+	rnd := newLockedRand(rand.NewSource(time.Now().UnixNano()))
+	life := newLifecycle()
 	c := &cache{
 		mu:              &sync.RWMutex{},
 		entries:         map[string]*centry{},
+		deps:            map[string]map[string]struct{}{},
 		defaultCT:       CacheValueReturnError,
 		defaultRT:       RefreshOnAccess,
 		defaultTTL:      ValueExpiryDefault,
 		checkDuplicates: NoDuplicateCheck,
+		bWindow:         DefaultBatchWindow,
+		rnd:             rnd,
+		clock:           realClock{},
+		life:            life,
+		w:               newWatchers(),
 		vCache: &valCache{
 			mu:              &sync.RWMutex{},
 			entries:         map[string]*vcentry{},
 			defaultTTL:      ValueExpiryDefault,
 			checkDuplicates: NoDuplicateCheck,
+			rnd:             rnd,
+			clock:           realClock{},
+			life:            life,
 		},
 	}
-	c.ctx = ctx
+	// cancelled when the cache is closed
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	go c.w.start(c.ctx)
 	return c
 }
 
@@ -79,35 +139,149 @@ func (c *cache) startJanitor() {
 	if c.jCycle == ValueExpiryNever {
 		c.jCycle = DefaultJanitorInterval
 	}
-	c.j = newJanitor(c.ctx, c, c.jCycle)
+	c.j = newJanitor(c, c.jCycle)
 	go c.j.start(c.ctx)
 }
 
-func (c *cache) newEntry(cb Call) *centry {
+// manage - hand entry over to the janitor if needs be, caller must hold entry lock
+func (c *cache) manage(k string, e *centry) {
+	if (e.rt == RefreshAsync || e.rt == NoRefresh) && !e.item.expires.IsZero() {
+		c.j.schedule(k, e, e.item.expires)
+	}
+}
+
+// ctxCall - internal representation of calls, so loaders and retries can use the callers' context
+type ctxCall func(ctx context.Context) (interface{}, error)
+
+func withCtx(cb Call) ctxCall {
+	return func(_ context.Context) (interface{}, error) {
+		return cb()
+	}
+}
+
+func (c *cache) newEntry(cb ctxCall) *centry {
 	return &centry{
 		item: &citem{
 			expires: time.Time{},
 		},
-		mu:  &sync.RWMutex{},
-		cb:  cb,
-		ct:  c.defaultCT,
-		rt:  c.defaultRT,
-		ttl: c.defaultTTL,
+		mu:     &sync.RWMutex{},
+		cb:     cb,
+		ct:     c.defaultCT,
+		rt:     c.defaultRT,
+		ttl:    c.defaultTTL,
+		errTTL: c.defaultErrTTL,
+		retry:  c.defaultRetry,
+		br:     newBreaker(c.defaultBreaker, c.clock),
+		jitter: c.defaultJitter,
+		rnd:    c.rnd,
+		clock:  c.clock,
 	}
 }
 
-func (e *centry) initItem() {
-	var exp time.Time
-	if e.ttl == ValueExpiryNever {
-		exp = time.Time{}
-	} else {
-		exp = time.Now().Add(e.ttl)
+func (e *centry) initItem(ctx context.Context) {
+	v, err := e.call(ctx, nil, nil)
+	if err == ErrNotModified {
+		// nothing to keep, the initial value is nil
+		err = nil
 	}
-	v, err := e.cb()
+	e.setItem(v, err)
+}
+
+// setItem - set the initial value of an entry
+func (e *centry) setItem(v interface{}, err error) {
 	e.item = &citem{
 		val:     v,
 		err:     err,
-		expires: exp,
+		version: nextVersion(),
+	}
+	e.setExpiry(err)
+	// No error, or we want to cache errors
+	if err != nil && e.ct != CacheAll && e.errTTL == 0 {
+		// ensure expired entry is stored, so next time we don't return cached error
+		e.item.expires = e.clock.Now().Add(-1 * time.Second)
+	}
+}
+
+// update - store the result of a call on an existing entry, according to its cache type
+// returns the value to return to the caller, and whether or not the entry was updated
+// caller must hold the entry lock
+func (e *centry) update(v interface{}, err error) (interface{}, bool) {
+	if err == ErrCircuitOpen {
+		// no call was made, leave the entry as-is
+		if e.ct == CacheValueReturnStaleOnError {
+			v, _ = e.staleValue(e.clock.Now())
+			return v, false
+		}
+		return nil, false
+	}
+	if err == ErrNotModified {
+		// keep the value, but it's valid for another TTL
+		e.item.err = nil
+		e.setExpiry(nil)
+		return e.item.val, false
+	}
+	if err == nil || e.ct == CacheAll {
+		e.item.val = v
+		e.item.err = err
+		e.item.version = nextVersion()
+		// an invalidated entry without TTL should become valid indefinitely again
+		e.setExpiry(err)
+		return v, true
+	}
+	if e.errTTL != 0 {
+		// negative caching: hold on to the error, so we don't call again right away
+		e.item.err = err
+		// the deadline of the stale value is kept, to determine how stale it is
+		e.item.expires = e.expiry(err)
+		if e.ct == CacheValueReturnStaleOnError {
+			v, _ = e.staleValue(e.clock.Now())
+			return v, false
+		}
+		e.item.val = v
+		e.item.deadline = e.item.expires
+		e.item.version = nextVersion()
+		return v, true
+	}
+	if e.ct == CacheValueReturnStaleOnError {
+		// return stale value + new error
+		v, _ = e.staleValue(e.clock.Now())
+		return v, false
+	}
+	// default, on error don't update
+	return v, false
+}
+
+// lifetime - get the TTL for a new call result, jitter included. Errors use the error TTL if set
+func (e *centry) lifetime(err error) time.Duration {
+	ttl := e.ttl
+	if err != nil && e.errTTL != 0 {
+		ttl = e.errTTL
+	}
+	if ttl == ValueExpiryNever {
+		return ValueExpiryNever
+	}
+	return jitterTTL(ttl, e.jitter, e.rnd)
+}
+
+// expiry - get the expiry time for a new call result, see lifetime
+func (e *centry) expiry(err error) time.Time {
+	ttl := e.lifetime(err)
+	if ttl == ValueExpiryNever {
+		return time.Time{}
+	}
+	return e.clock.Now().Add(ttl)
+}
+
+// setExpiry - set the expiry of the item after it was written, caller must hold lock
+func (e *centry) setExpiry(err error) {
+	e.item.ttl = e.lifetime(err)
+	e.item.deadline = time.Time{}
+	if e.item.ttl != ValueExpiryNever {
+		e.item.deadline = e.clock.Now().Add(e.item.ttl)
+	}
+	e.item.expires = e.item.deadline
+	if err == nil {
+		e.item.touch(e.clock.Now(), e.idle)
 	}
 }
 
@@ -116,22 +290,76 @@ func (c *cache) Set(key string, call Call, opts ...EntryConfig) (interface{}, er
 	if c.checkDuplicates == CheckDuplicate {
 		return c.setWithCheck(key, call, opts...)
 	}
+	if !c.life.begin() {
+		return nil, ErrCacheClosed
+	}
 	// Obtain read lock, even though we're writing. This lock is not really doing anything
 	// but is here to defend against race conditions in case CAS is called with the same key
 	// setWithCheck obtains full lock, RLock allows for reads, still, while a set will be atomic
 	c.mu.Lock()
-	i, err := c.set(key, call, opts...)
+	ent, old, err := c.set(key, withCtx(call), opts...)
 	c.mu.Unlock()
-	return i, err
+	if err != nil {
+		c.life.end()
+		return nil, err
+	}
+	v, err := c.fill(c.ctx, key, ent, old)
+	c.life.end()
+	return v, err
+}
+
+// SetRefreshCall - Set, the call gets the previous value and error when the entry is refreshed
+// returning ErrNotModified keeps the previous value, and extends its expiry
+func (c *cache) SetRefreshCall(key string, call RefreshCall, opts ...EntryConfig) (interface{}, error) {
+	if !c.life.begin() {
+		return nil, ErrCacheClosed
+	}
+	c.mu.Lock()
+	if _, ok := c.entries[key]; ok && c.checkDuplicates == CheckDuplicate {
+		c.mu.Unlock()
+		c.life.end()
+		return nil, ErrDuplicateEntry
+	}
+	ent, old, err := c.set(key, func(ctx context.Context) (interface{}, error) {
+		return call(ctx, nil, nil)
+	}, opts...)
+	if err == nil {
+		ent.rcb = call
+	}
+	c.mu.Unlock()
+	if err != nil {
+		c.life.end()
+		return nil, err
+	}
+	v, err := c.fill(c.ctx, key, ent, old)
+	c.life.end()
+	return v, err
 }
 
 func (c *cache) Unset(key string) {
+	c.unset(key, CauseUnset)
+}
+
+// unset - remove the entry, the cause is passed on to watchers
+func (c *cache) unset(key string, cause EventCause) {
+	if c.life.isClosed() {
+		return
+	}
 	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.unlinkDeps(key, e.deps)
+	}
 	// delete - it's a no-op if the element isn't set, no need to check
 	delete(c.entries, key)
-	// might not be needed, but janitor isn't as time critical as the cache itself
-	c.j.dch <- key
 	c.mu.Unlock()
+	if ok && c.w.active() {
+		e.mu.RLock()
+		c.changed(key, e.item.val, nil, nil, cause)
+		e.mu.RUnlock()
+	}
+	c.j.unschedule(key)
+	c.invalidate(key)
 }
 
 // CAS - Check & Set, same as set but "atomic", returns DuplicateEntryErr if value already exists
@@ -149,79 +377,312 @@ func (c *cache) Has(key string) bool {
 
 // Refresh - manually/forcibly refresh given cache value
 func (c *cache) Refresh(k string) (interface{}, error) {
+	return c.RefreshCtx(c.ctx, k)
+}
+
+// RefreshCtx - Refresh, failing calls are retried until the context is done
+func (c *cache) RefreshCtx(ctx context.Context, k string) (interface{}, error) {
+	if !c.life.begin() {
+		return nil, ErrCacheClosed
+	}
 	c.mu.RLock()
 	ce, err := c.get(k)
 	c.mu.RUnlock()
 	if err != nil {
+		c.life.end()
 		return nil, err
 	}
 	ce.mu.Lock()
-	v, err := ce.cb()
-	if err == nil || ce.ct == CacheAll {
-		ce.item.val = v
-		ce.item.err = err
-		if ce.ttl != ValueExpiryNever {
-			ce.item.expires = time.Now().Add(ce.ttl)
-		}
+	old, oldErr, ver, exp := ce.item.val, ce.item.err, ce.item.version, ce.item.expires
+	v, err := ce.invoke(ctx, old, oldErr)
+	for attempt := 1; ce.retryable(err, attempt); attempt++ {
+		// don't hold the lock while backing off, concurrent reads shouldn't wait on our retries
 		ce.mu.Unlock()
-		return v, err
+		ok := ce.wait(ctx, attempt)
+		ce.mu.Lock()
+		if ce.item.version != ver || ce.item.expires.After(exp) {
+			// refreshed by someone else in the mean time
+			v, err = ce.item.val, ce.item.err
+			ce.mu.Unlock()
+			c.life.end()
+			return v, err
+		}
+		if !ok {
+			break
+		}
+		v, err = ce.invoke(ctx, old, oldErr)
 	}
-	if ce.ct == CacheValueReturnStaleOnError {
-		// get stale value
-		v = ce.item.val
-		ce.mu.Unlock()
-		// return stale value + new error
-		return v, err
+	v, updated := ce.update(v, err)
+	if updated {
+		c.changed(k, old, v, err, CauseRefresh)
 	}
-	// default, on error don't update
 	ce.mu.Unlock()
+	if updated {
+		c.invalidate(k)
+	}
+	if err == ErrNotModified {
+		err = nil
+	}
+	c.life.end()
 	return v, err
 }
 
-func (c *cache) autoRefresh(key string, val interface{}, err error) {
-	c.mu.RLock()
-	ce := c.entries[key] // this is guaranteed to work -> the janitor calls this, the key exists
-	c.mu.RUnlock()
+// autoRefresh - update entry after janitor refreshed it, returns true if the value was updated
+func (c *cache) autoRefresh(ce *centry, val interface{}, err error) bool {
 	// the item is still locked ATM, by the janitor
-	if err == nil || ce.ct == CacheAll {
-		ce.item.val = val
-		ce.item.err = err
-		ce.item.expires = time.Now().Add(ce.ttl)
-	}
-	// all others should be a no-op, they cannot be auto-refreshed
+	// all errors not cached should be a no-op, they cannot be auto-refreshed
+	_, updated := ce.update(val, err)
+	return updated
 }
 
 // Get - get cached values
 func (c *cache) Get(key string) (interface{}, error) {
+	return c.GetCtx(c.ctx, key)
+}
+
+// GetCtx - get cached values, the context is used for any calls made to refresh or load the value
+func (c *cache) GetCtx(ctx context.Context, key string) (interface{}, error) {
+	if !c.life.begin() {
+		return nil, ErrCacheClosed
+	}
+	v, err := c.getCtx(ctx, key)
+	c.life.end()
+	return v, err
+}
+
+func (c *cache) getCtx(ctx context.Context, key string) (interface{}, error) {
 	c.mu.RLock()
 	ce, err := c.get(key)
 	c.mu.RUnlock()
 	if err != nil {
+		if c.loader != nil {
+			return c.load(ctx, key, c.loaderCall(key))
+		}
 		return nil, err
 	}
 	ce.mu.RLock()
 	v, err, exp := ce.item.val, ce.item.err, ce.item.expires
 	// value is still valid, return and be done with it
-	now := time.Now()
+	now := c.clock.Now()
 	if exp.IsZero() || exp.After(now) {
+		if err != nil && ce.ct == CacheValueReturnStaleOnError {
+			// error is cached, v is the stale value
+			v, _ = ce.staleValue(now)
+		}
+		early := ce.rt == RefreshOnAccess && ce.refreshEarly(now)
+		ahead := !early && ce.refreshAheadDue(now)
 		ce.mu.RUnlock()
+		if early {
+			return c.refreshAhead(ctx, key, ce, v, err)
+		}
+		if ce.idle > 0 {
+			ce.mu.Lock()
+			// check the value wasn't changed in the mean time
+			if ce.item.err == nil && !ce.item.expired(now) {
+				ce.item.touch(now, ce.idle)
+			}
+			ce.mu.Unlock()
+		}
+		if ahead && atomic.LoadInt32(&ce.refreshing) == 0 && c.life.begin() {
+			// don't wait for the refresh, the request context may be gone by the time we're done
+			go func() {
+				c.refreshAhead(c.ctx, key, ce, v, err)
+				c.life.end()
+			}()
+		}
 		// this is really optimistic, we're not handling errors correctly ATM
 		return v, err
 	}
 	// value has expired
 	if ce.rt == RefreshExplicit {
+		_, ok := ce.staleValue(now)
 		ce.mu.RUnlock()
+		if !ok {
+			return nil, ErrValueTooStale
+		}
 		return v, ErrValueExpired
 	}
 	if exp.Before(now) && ce.rt == NoRefresh {
 		ce.mu.RUnlock()
-		c.Unset(key)
+		c.unset(key, CauseExpired)
 		// this entry is gone now
+		if c.loader != nil {
+			return c.load(ctx, key, c.loaderCall(key))
+		}
 		return nil, ErrKeyNotFound
 	}
+	if ce.rt == RefreshAsync {
+		if _, ok := ce.staleValue(now); !ok {
+			v = nil
+			if err == nil {
+				err = ErrValueTooStale
+			}
+		}
+		ce.mu.RUnlock()
+		// serve stale, the janitor is probably already on it, if not: refresh in the background
+		if atomic.LoadInt32(&ce.refreshing) == 0 && c.life.begin() {
+			go func() {
+				c.refreshAhead(c.ctx, key, ce, v, err)
+				c.life.end()
+			}()
+		}
+		return v, err
+	}
 	ce.mu.RUnlock()
-	// ignore RefreshAsync for the time being
-	return c.Refresh(key)
+	return c.RefreshCtx(ctx, key)
+}
+
+// load - read-through, add an entry for an unknown key using the given call
+// concurrent Get calls block on the new entry, so the call is made only once
+func (c *cache) load(ctx context.Context, key string, cb ctxCall, opts ...EntryConfig) (interface{}, error) {
+	c.mu.Lock()
+	if _, ok := c.entries[key]; ok {
+		// someone beat us to it
+		c.mu.Unlock()
+		return c.getCtx(ctx, key)
+	}
+	ent, _, err := c.set(key, cb, opts...)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return c.fill(ctx, key, ent, nil)
+}
+
+// loaderCall - call for entries added by the cache loader
+func (c *cache) loaderCall(key string) ctxCall {
+	return func(ctx context.Context) (interface{}, error) {
+		return c.loader(ctx, key)
+	}
+}
+
+// GetMulti - get cached values for multiple keys, loading misses and expired keys in a single batch
+func (c *cache) GetMulti(keys []string) (map[string]interface{}, map[string]error) {
+	if !c.life.begin() {
+		errs := make(map[string]error, len(keys))
+		for _, k := range keys {
+			errs[k] = ErrCacheClosed
+		}
+		return map[string]interface{}{}, errs
+	}
+	vals, errs := c.getMulti(keys)
+	c.life.end()
+	return vals, errs
+}
+
+func (c *cache) getMulti(keys []string) (map[string]interface{}, map[string]error) {
+	vals := make(map[string]interface{}, len(keys))
+	errs := map[string]error{}
+	if c.batch == nil {
+		// no batch call, just get the keys one by one
+		for _, k := range keys {
+			v, err := c.Get(k)
+			if err != nil {
+				errs[k] = err
+			}
+			if v != nil {
+				vals[k] = v
+			}
+		}
+		return vals, errs
+	}
+	load := make([]string, 0, len(keys))
+	now := c.clock.Now()
+	for _, k := range keys {
+		c.mu.RLock()
+		ce, err := c.get(k)
+		c.mu.RUnlock()
+		if err != nil {
+			load = append(load, k)
+			continue
+		}
+		ce.mu.RLock()
+		v, err, exp, rt := ce.item.val, ce.item.err, ce.item.expires, ce.rt
+		ce.mu.RUnlock()
+		if exp.IsZero() || exp.After(now) {
+			vals[k] = v
+			if err != nil {
+				errs[k] = err
+			}
+			continue
+		}
+		if rt == RefreshExplicit {
+			vals[k] = v
+			errs[k] = ErrValueExpired
+			continue
+		}
+		load = append(load, k)
+	}
+	if len(load) == 0 {
+		return vals, errs
+	}
+	b := c.batch.load(load)
+	for _, k := range load {
+		if v := b.vals[k]; v != nil {
+			vals[k] = v
+		}
+		if err := b.errs[k]; err != nil {
+			errs[k] = err
+		}
+	}
+	return vals, errs
+}
+
+// storeBatch - store the results of a BatchCall, returns the values and errors to return
+func (c *cache) storeBatch(keys []string, vals map[string]interface{}, errs map[string]error) (map[string]interface{}, map[string]error) {
+	rVals := make(map[string]interface{}, len(keys))
+	rErrs := map[string]error{}
+	for _, k := range keys {
+		v, vok := vals[k]
+		err, eok := errs[k]
+		if !vok && !eok {
+			// don't cache misses, or asking for random keys would grow the cache forever
+			rErrs[k] = ErrKeyNotFound
+			continue
+		}
+		c.mu.Lock()
+		ce, ok := c.entries[k]
+		if !ok {
+			ce = c.newEntry(withCtx(c.batch.single(k)))
+			ce.setItem(v, err)
+			c.entries[k] = ce
+			c.changed(k, nil, v, err, CauseSet)
+			c.mu.Unlock()
+			c.manage(k, ce)
+		} else {
+			c.mu.Unlock()
+			ce.mu.Lock()
+			old := ce.item.val
+			v, ok = ce.update(v, err)
+			if ok {
+				c.changed(k, old, v, err, CauseRefresh)
+			}
+			ce.mu.Unlock()
+		}
+		if ok {
+			c.invalidate(k)
+		}
+		if v != nil {
+			rVals[k] = v
+		}
+		if err != nil {
+			rErrs[k] = err
+		}
+	}
+	return rVals, rErrs
+}
+
+// Stats - get a snapshot of the cache statistics
+func (c *cache) Stats() Stats {
+	c.mu.RLock()
+	s := Stats{
+		Keys: make(map[string]KeyStats, len(c.entries)),
+	}
+	for k, e := range c.entries {
+		s.Keys[k] = e.stats()
+	}
+	c.mu.RUnlock()
+	return s
 }
 
 func (c *cache) Value() ValueCache {
@@ -229,37 +690,71 @@ func (c *cache) Value() ValueCache {
 }
 
 func (c *cache) setWithCheck(k string, cb Call, opts ...EntryConfig) (interface{}, error) {
+	if !c.life.begin() {
+		return nil, ErrCacheClosed
+	}
 	c.mu.Lock()
 	if _, ok := c.entries[k]; ok {
 		c.mu.Unlock()
+		c.life.end()
 		return nil, ErrDuplicateEntry
 	}
 	// regular call to set, but we have obtained a lock here...
-	i, err := c.set(k, cb, opts...)
+	ent, _, err := c.set(k, withCtx(cb), opts...)
 	c.mu.Unlock()
-	return i, err
+	if err != nil {
+		c.life.end()
+		return nil, err
+	}
+	v, err := c.fill(c.ctx, k, ent, nil)
+	c.life.end()
+	return v, err
 }
 
-func (c *cache) set(k string, cb Call, opts ...EntryConfig) (interface{}, error) {
+// set - add new entry to the cache, caller must hold lock. The entry is returned locked
+// so the call can be made (using fill) without blocking the entire cache
+// the entry it replaces is returned, too (nil if there was none)
+func (c *cache) set(k string, cb ctxCall, opts ...EntryConfig) (*centry, *centry, error) {
 	ent := c.newEntry(cb)
 	for _, o := range opts {
 		o(ent)
 	}
-	ent.initItem()
-	if ent.rt == RefreshAsync {
-		// notify janitor there's something to manage
-		c.j.sch <- k
+	for _, d := range ent.deps {
+		if d == k || c.dependsOn(d, k) {
+			return nil, nil, ErrDependencyCycle
+		}
 	}
-	// No error, or we want to cache errors
-	if ent.item.err == nil || ent.ct == CacheAll {
-		c.entries[k] = ent
-		return ent.item.val, ent.item.err
+	old, ok := c.entries[k]
+	if ok {
+		c.unlinkDeps(k, old.deps)
 	}
-	// ensure expired entry is stored, so next time we don't return cached error
-	ent.item.expires = time.Now().Add(-1 * time.Second)
+	c.linkDeps(k, ent.deps)
+	// concurrent reads will block until the call has been made
+	ent.mu.Lock()
 	c.entries[k] = ent
+	return ent, old, nil
+}
+
+// fill - make the initial call for an entry returned by set, and release it
+// old is the entry it replaced, if any, its value is passed on to watchers
+func (c *cache) fill(ctx context.Context, k string, ent, old *centry) (interface{}, error) {
+	ent.initItem(ctx)
+	v, err := ent.item.val, ent.item.err
+	// notify janitor there's something to manage
+	c.manage(k, ent)
+	if c.w.active() {
+		var prev interface{}
+		if old != nil {
+			old.mu.RLock()
+			prev = old.item.val
+			old.mu.RUnlock()
+		}
+		c.changed(k, prev, v, err, CauseSet)
+	}
+	ent.mu.Unlock()
+	c.invalidate(k)
 	// return call as it happened
-	return ent.item.val, ent.item.err
+	return v, err
 }
 
 // get, return RAW POINTER of cached value, careful when manipulating this one (use locks!)
@@ -271,115 +766,248 @@ func (c *cache) get(k string) (*centry, error) {
 	return e, nil
 }
 
+// dependsOn - check whether key (transitively) depends on parent, caller must hold lock
+func (c *cache) dependsOn(key, parent string) bool {
+	seen := map[string]struct{}{}
+	queue := []string{parent}
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		for d := range c.deps[k] {
+			if d == key {
+				return true
+			}
+			if _, ok := seen[d]; !ok {
+				seen[d] = struct{}{}
+				queue = append(queue, d)
+			}
+		}
+	}
+	return false
+}
+
+// linkDeps - register key as dependent of each of the parents, caller must hold lock
+func (c *cache) linkDeps(key string, parents []string) {
+	for _, p := range parents {
+		if _, ok := c.deps[p]; !ok {
+			c.deps[p] = map[string]struct{}{}
+		}
+		c.deps[p][key] = struct{}{}
+	}
+}
+
+// unlinkDeps - remove key from the dependents of its parents, caller must hold lock
+func (c *cache) unlinkDeps(key string, parents []string) {
+	for _, p := range parents {
+		delete(c.deps[p], key)
+		if len(c.deps[p]) == 0 {
+			delete(c.deps, p)
+		}
+	}
+}
+
+// invalidate - expire every entry (transitively) depending on key
+// must be called without holding any locks: dependent calls may well Get their parents
+func (c *cache) invalidate(key string) {
+	c.mu.RLock()
+	if len(c.deps[key]) == 0 {
+		c.mu.RUnlock()
+		return
+	}
+	queue := []string{key}
+	entries := map[string]*centry{}
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		for d := range c.deps[k] {
+			if _, ok := entries[d]; ok {
+				continue
+			}
+			queue = append(queue, d)
+			// entries that don't exist are nil, so we still keep track of them
+			entries[d] = c.entries[d]
+		}
+	}
+	c.mu.RUnlock()
+	exp := c.clock.Now().Add(-1 * time.Second)
+	for k, e := range entries {
+		if e == nil {
+			continue
+		}
+		e.mu.Lock()
+		e.item.expires = exp
+		c.manage(k, e)
+		e.mu.Unlock()
+	}
+}
+
 // value cache implementation:
+// entries are only changed, or removed, while holding the entry lock
+// the entry lock is never acquired while holding the cache lock
 
 func (c *valCache) Get(key string) (interface{}, error) {
+	if c.life.isClosed() {
+		return nil, ErrCacheClosed
+	}
 	c.mu.RLock()
-	e, err := c.get(key)
-	if err != nil {
-		if e != nil {
-			c.mu.RUnlock()
-			return e.item.val, err
-		}
-		c.mu.RUnlock()
-		return nil, err
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	e.mu.RLock()
+	if e.item == nil {
+		// placeholder for a value being computed
+		e.mu.RUnlock()
+		return nil, ErrKeyNotFound
 	}
-	// get the cached value
 	ret := e.item.val
-	c.mu.RUnlock()
+	now := c.clock.Now()
+	if e.item.expired(now) {
+		e.mu.RUnlock()
+		return ret, ErrValueExpired
+	}
+	idle := e.idle
+	e.mu.RUnlock()
+	if idle > 0 {
+		e.mu.Lock()
+		// check the value wasn't changed, or removed in the mean time
+		if e.item != nil && !e.item.expired(now) {
+			e.item.touch(now, e.idle)
+		}
+		e.mu.Unlock()
+	}
 	return ret, nil
 }
 
 func (c *valCache) Set(key string, value interface{}, opts ...EntryConfig) error {
-	c.mu.Lock()
-	if c.checkDuplicates == CheckDuplicate {
-		if _, ok := c.entries[key]; ok {
-			c.mu.Unlock()
-			return ErrDuplicateEntry
+	var err error
+	_, cErr := c.compute(key, func(it *citem, _ bool) (interface{}, computeOp) {
+		if it != nil && c.checkDuplicates == CheckDuplicate {
+			err = ErrDuplicateEntry
+			return nil, computeNone
 		}
+		return value, computeStore
+	}, opts...)
+	if cErr == ErrCacheClosed {
+		return cErr
 	}
-	c.set(key, value, opts...)
-	c.mu.Unlock()
-	return nil
+	return err
 }
 
 func (c *valCache) Refresh(key string) (interface{}, error) {
+	if c.life.isClosed() {
+		return nil, ErrCacheClosed
+	}
 	c.mu.RLock()
-	e, err := c.get(key)
+	e, ok := c.entries[key]
 	c.mu.RUnlock()
-	if err != nil && err != ErrValueExpired {
-		return nil, err
+	if !ok {
+		return nil, ErrKeyNotFound
 	}
 	e.mu.Lock()
+	if e.item == nil {
+		e.mu.Unlock()
+		return nil, ErrKeyNotFound
+	}
 	ret := e.item.val
 	// this is a pointless call
-	if e.ttl == ValueExpiryNever {
+	if e.ttl == ValueExpiryNever && e.idle == 0 {
 		e.mu.Unlock()
 		return ret, nil
 	}
 	// only set TTL if we have to
-	e.item.expires = time.Now().Add(e.ttl)
+	now := c.clock.Now()
+	e.item.deadline = time.Time{}
+	if e.ttl != ValueExpiryNever {
+		e.item.deadline = now.Add(jitterTTL(e.ttl, e.jitter, e.rnd))
+	}
+	e.item.expires = e.item.deadline
+	e.item.touch(now, e.idle)
 	e.mu.Unlock()
 	return ret, nil
 }
 
 func (c *valCache) Has(key string) bool {
 	c.mu.RLock()
-	_, ok := c.entries[key]
+	e, ok := c.entries[key]
 	c.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	e.mu.RLock()
+	ok = e.item != nil
+	e.mu.RUnlock()
 	return ok
 }
 
 func (c *valCache) CAS(key string, value interface{}, opts ...EntryConfig) (interface{}, error) {
-	c.mu.Lock()
-	if e, err := c.get(key); err == nil {
-		// we have a duplicate
-		// return existing entry + error
-		c.mu.Unlock()
-		return e.item.val, ErrDuplicateEntry
+	var err error
+	v, cErr := c.compute(key, func(it *citem, valid bool) (interface{}, computeOp) {
+		if valid {
+			// we have a duplicate
+			// return existing entry + error
+			err = ErrDuplicateEntry
+			return it.val, computeNone
+		}
+		return value, computeStore
+	}, opts...)
+	if cErr == ErrCacheClosed {
+		return nil, cErr
 	}
-	delete(c.entries, key)
-	c.set(key, value, opts...)
-	c.mu.Unlock()
-	return value, nil
+	return v, err
 }
 
 func (c *valCache) Unset(key string) {
-	c.mu.Lock()
-	delete(c.entries, key)
-	c.mu.Unlock()
-}
-
-func (c *valCache) get(key string) (*vcentry, error) {
+	if c.life.isClosed() {
+		return
+	}
+	c.mu.RLock()
 	e, ok := c.entries[key]
+	c.mu.RUnlock()
 	if !ok {
-		return nil, ErrKeyNotFound
+		return
 	}
-	if !e.item.expires.IsZero() && e.item.expires.Before(time.Now()) {
-		return e, ErrValueExpired
+	e.mu.Lock()
+	if !e.removed {
+		c.remove(key, e)
 	}
-	return e, nil
+	e.mu.Unlock()
 }
 
-func (c *valCache) set(key string, value interface{}, opts ...EntryConfig) {
-	// create entry
-	e := &vcentry{
-		item: &citem{
-			val:     value,
-			expires: time.Time{},
-		},
-		mu:  &sync.RWMutex{},
-		ttl: c.defaultTTL,
-	}
+// remove - remove entry from the cache, caller must hold the entry lock
+func (c *valCache) remove(key string, e *vcentry) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+	e.item = nil
+	e.removed = true
+}
+
+// store - (re)configure the entry and store the value, caller must hold the entry lock
+// the expiry is kept if the KeepTTL option is passed, and the current value is still valid
+func (c *valCache) store(e *vcentry, value interface{}, valid bool, opts ...EntryConfig) {
+	e.ttl, e.jitter, e.rnd, e.keepTTL, e.idle = c.defaultTTL, c.defaultJitter, c.rnd, false, 0
 	// configure
 	for _, o := range opts {
 		o(e)
 	}
-	// set TTL if value has expiry
-	if e.ttl != ValueExpiryNever {
-		e.item.expires = time.Now().Add(e.ttl)
+	it := &citem{
+		val:     value,
+		version: nextVersion(),
 	}
-	c.entries[key] = e
+	now := c.clock.Now()
+	if valid && e.keepTTL {
+		it.expires, it.deadline = e.item.expires, e.item.deadline
+	} else {
+		if e.ttl != ValueExpiryNever {
+			// set TTL if value has expiry
+			it.deadline = now.Add(jitterTTL(e.ttl, e.jitter, e.rnd))
+		}
+		it.expires = it.deadline
+		it.touch(now, e.idle)
+	}
+	e.item = it
 }
 
 // entryConfigInterface
@@ -396,6 +1024,44 @@ func (e *centry) SetRefreshType(rt RefreshType) {
 	e.rt = rt
 }
 
+func (e *centry) setErrTTL(ttl time.Duration) {
+	e.errTTL = ttl
+}
+
+func (e *centry) setRetry(p retryPolicy) {
+	e.retry = p
+}
+
+func (e *centry) setBreaker(b breakerConf) {
+	e.br = newBreaker(b, e.clock)
+}
+
+func (e *centry) setJitter(fraction float64) {
+	e.jitter = fraction
+}
+
+func (e *centry) setEarlyRefresh(beta float64) {
+	e.beta = beta
+}
+
+func (e *centry) setRefreshAhead(fraction float64) {
+	e.ahead = fraction
+}
+
+func (e *centry) setDeps(keys []string) {
+	e.deps = keys
+}
+
+func (e *centry) setKeepTTL(_ bool) {}
+
+func (e *centry) setIdle(d time.Duration) {
+	e.idle = d
+}
+
+func (e *centry) setMaxStale(d time.Duration) {
+	e.maxAge = d
+}
+
 func (v *vcentry) setCT(_ CacheType) {}
 
 func (v *vcentry) SetRefreshType(_ RefreshType) {}
@@ -403,3 +1069,29 @@ func (v *vcentry) SetRefreshType(_ RefreshType) {}
 func (v *vcentry) setTTL(ttl time.Duration) {
 	v.ttl = ttl
 }
+
+func (v *vcentry) setErrTTL(_ time.Duration) {}
+
+func (v *vcentry) setRetry(_ retryPolicy) {}
+
+func (v *vcentry) setBreaker(_ breakerConf) {}
+
+func (v *vcentry) setJitter(fraction float64) {
+	v.jitter = fraction
+}
+
+func (v *vcentry) setEarlyRefresh(_ float64) {}
+
+func (v *vcentry) setRefreshAhead(_ float64) {}
+
+func (v *vcentry) setDeps(_ []string) {}
+
+func (v *vcentry) setKeepTTL(keep bool) {
+	v.keepTTL = keep
+}
+
+func (v *vcentry) setIdle(d time.Duration) {
+	v.idle = d
+}
+
+func (v *vcentry) setMaxStale(_ time.Duration) {}
@@ -1,11 +1,16 @@
 package memoise_test
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/EVODelavega/go-memoise"
+	"github.com/EVODelavega/go-memoise/clocktest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -127,9 +132,11 @@ func TestExpireRefreshOnAccess(t *testing.T) {
 		}
 	}()
 	// use overrides
+	clock := clocktest.New(time.Now())
 	cache := memoise.New(
 		memoise.DefaultRefreshType(memoise.RefreshOnAccess),
 		memoise.DefaultTTL(memoise.ValueExpiryNever),
+		memoise.WithClock(clock),
 	)
 	never, err := cache.Set("never", noExpiry)
 	assert.NoError(t, err)
@@ -137,7 +144,7 @@ func TestExpireRefreshOnAccess(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, ms, never)
 	// wait for cache to expire
-	time.Sleep(time.Millisecond)
+	clock.Advance(time.Millisecond)
 	never, _ = cache.Get("never")
 	ms, _ = cache.Get("ms")
 	assert.NotEqual(t, ms, never)
@@ -145,7 +152,7 @@ func TestExpireRefreshOnAccess(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, never, ms)
 	// test CAS behaviour with both expired and non-expired values
-	time.Sleep(time.Millisecond)
+	clock.Advance(time.Millisecond)
 	_, err = cache.CAS("never", noExpiry)
 	assert.Error(t, err)
 	assert.Equal(t, memoise.ErrDuplicateEntry, err)
@@ -179,9 +186,11 @@ func TestCheckDuplicates(t *testing.T) {
 }
 
 func TestValueRefresh(t *testing.T) {
+	clock := clocktest.New(time.Now())
 	cache := memoise.New(
 		memoise.DefaultTTL(time.Millisecond),          // expire values after 1ms
 		memoise.DefaultRefreshType(memoise.NoRefresh), // don't refresh expired values
+		memoise.WithClock(clock),
 	)
 	const (
 		expireKey = "expires"
@@ -190,7 +199,7 @@ func TestValueRefresh(t *testing.T) {
 	val := 42
 	assert.NoError(t, cache.Value().Set(expireKey, val))
 	assert.NoError(t, cache.Value().Set(neverKey, val, memoise.SetTTL(memoise.ValueExpiryNever)))
-	time.Sleep(time.Millisecond)
+	clock.Advance(2 * time.Millisecond)
 	rVal, err := cache.Value().Refresh(expireKey)
 	assert.NoError(t, err)
 	assert.Equal(t, val, rVal)
@@ -198,7 +207,7 @@ func TestValueRefresh(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, val, rVal)
 
-	time.Sleep(time.Millisecond)
+	clock.Advance(2 * time.Millisecond)
 	rVal, err = cache.Value().Get(expireKey)
 	assert.Error(t, err)
 	assert.Equal(t, memoise.ErrValueExpired, err)
@@ -293,3 +302,1174 @@ func TestReturnErrorNotCached(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, val, rVal)
 }
+
+func TestDependsOn(t *testing.T) {
+	cache := memoise.New(memoise.DefaultTTL(memoise.ValueExpiryNever))
+	roles := 1
+	_, err := cache.Set("roles:42", func() (interface{}, error) {
+		return roles, nil
+	})
+	assert.NoError(t, err)
+	permissions := func() (interface{}, error) {
+		r, err := cache.Get("roles:42")
+		if err != nil {
+			return nil, err
+		}
+		return r.(int) * 10, nil
+	}
+	val, err := cache.Set("permissions:42", permissions, memoise.DependsOn("roles:42"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, val)
+	_, err = cache.Set("audit:42", permissions, memoise.DependsOn("permissions:42"))
+	assert.NoError(t, err)
+	// refreshing the parent should invalidate the dependents
+	roles = 2
+	_, err = cache.Refresh("roles:42")
+	assert.NoError(t, err)
+	val, err = cache.Get("permissions:42")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, val)
+	val, err = cache.Get("audit:42")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, val)
+	// unsetting the parent, too
+	cache.Unset("roles:42")
+	_, err = cache.Get("permissions:42")
+	assert.Equal(t, memoise.ErrKeyNotFound, err)
+	// cycles are rejected before the call is made
+	_, err = cache.Set("roles:42", permissions, memoise.DependsOn("audit:42"))
+	assert.Equal(t, memoise.ErrDependencyCycle, err)
+	assert.False(t, cache.Has("roles:42"))
+	_, err = cache.Set("self", permissions, memoise.DependsOn("self"))
+	assert.Equal(t, memoise.ErrDependencyCycle, err)
+}
+
+func TestGetMultiBatch(t *testing.T) {
+	mu := sync.Mutex{}
+	calls := [][]string{}
+	batchCall := func(keys []string) (map[string]interface{}, map[string]error) {
+		mu.Lock()
+		calls = append(calls, keys)
+		mu.Unlock()
+		vals := map[string]interface{}{}
+		for _, k := range keys {
+			if k != "missing" {
+				vals[k] = "value-" + k
+			}
+		}
+		return vals, nil
+	}
+	cache := memoise.New(
+		memoise.WithBatchCall(batchCall),
+		memoise.BatchWindow(50*time.Millisecond),
+	)
+	_, err := cache.Set("set", func() (interface{}, error) {
+		return "from set", nil
+	})
+	assert.NoError(t, err)
+	// concurrent requests should be merged into a single call
+	wg := sync.WaitGroup{}
+	for _, keys := range [][]string{{"a", "b"}, {"b", "c"}, {"set", "missing"}} {
+		wg.Add(1)
+		go func(keys []string) {
+			vals, errs := cache.GetMulti(keys)
+			for _, k := range keys {
+				switch k {
+				case "set":
+					assert.Equal(t, "from set", vals[k])
+				case "missing":
+					assert.Equal(t, memoise.ErrKeyNotFound, errs[k])
+				default:
+					assert.Equal(t, "value-"+k, vals[k])
+				}
+			}
+			wg.Done()
+		}(keys)
+	}
+	wg.Wait()
+	assert.Len(t, calls, 1)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "missing"}, calls[0])
+	// loaded values are cached
+	vals, errs := cache.GetMulti([]string{"a", "b", "c"})
+	assert.Empty(t, errs)
+	assert.Len(t, vals, 3)
+	assert.Len(t, calls, 1)
+	// and can be refreshed individually
+	v, err := cache.Refresh("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "value-a", v)
+	assert.Len(t, calls, 2)
+	assert.Equal(t, []string{"a"}, calls[1])
+	// keys that weren't found aren't cached
+	assert.False(t, cache.Has("missing"))
+	assert.NotContains(t, cache.Stats().Keys, "missing")
+	_, errs = cache.GetMulti([]string{"missing"})
+	assert.Equal(t, memoise.ErrKeyNotFound, errs["missing"])
+	assert.Len(t, calls, 3)
+	assert.Equal(t, []string{"missing"}, calls[2])
+	// the batch window doesn't depend on the cache clock
+	clock := clocktest.New(time.Now())
+	cache = memoise.New(
+		memoise.WithBatchCall(batchCall),
+		memoise.WithClock(clock),
+		memoise.DefaultTTL(time.Minute),
+	)
+	vals, errs = cache.GetMulti([]string{"a", "b"})
+	assert.Empty(t, errs)
+	assert.Equal(t, map[string]interface{}{"a": "value-a", "b": "value-b"}, vals)
+	assert.Len(t, calls, 4)
+	// expiry does use the clock
+	vals, _ = cache.GetMulti([]string{"a", "b"})
+	assert.Len(t, vals, 2)
+	assert.Len(t, calls, 4)
+	clock.Advance(2 * time.Minute)
+	vals, _ = cache.GetMulti([]string{"a", "b"})
+	assert.Len(t, vals, 2)
+	assert.Len(t, calls, 5)
+}
+
+func TestReadThroughLoader(t *testing.T) {
+	var calls int32
+	loader := func(ctx context.Context, key string) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		// give concurrent calls some time to pile up
+		time.Sleep(10 * time.Millisecond)
+		return "value-" + key, nil
+	}
+	cache := memoise.New(
+		memoise.WithLoader(loader),
+		memoise.DefaultTTL(memoise.ValueExpiryNever),
+	)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			v, err := cache.Get("key")
+			assert.NoError(t, err)
+			assert.Equal(t, "value-key", v)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.True(t, cache.Has("key"))
+	// the loader is reused to refresh the value
+	v, err := cache.Refresh("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value-key", v)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestErrorTTL(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(
+		memoise.DefaultTTL(time.Millisecond),
+		memoise.DefaultErrorTTL(50*time.Millisecond),
+		memoise.WithClock(clock),
+	)
+	callErr := fmt.Errorf("call error")
+	calls := 0
+	cb := func() (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return calls, nil
+		}
+		return nil, callErr
+	}
+	val, err := cache.Set("error", func() (interface{}, error) {
+		calls++
+		return nil, callErr
+	})
+	assert.Nil(t, val)
+	assert.Equal(t, callErr, err)
+	// error is cached, call isn't made
+	val, err = cache.Get("error")
+	assert.Nil(t, val)
+	assert.Equal(t, callErr, err)
+	assert.Equal(t, 1, calls)
+	clock.Advance(50 * time.Millisecond)
+	_, err = cache.Get("error")
+	assert.Equal(t, callErr, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	val, err = cache.Set("stale", cb, memoise.SetCacheType(memoise.CacheValueReturnStaleOnError))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, val)
+	clock.Advance(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		// stale value + error, without calling again
+		val, err = cache.Get("stale")
+		assert.Equal(t, 1, val)
+		assert.Equal(t, callErr, err)
+		assert.Equal(t, 2, calls)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	cache := memoise.New(
+		memoise.DefaultTTL(memoise.ValueExpiryNever),
+		memoise.DefaultRetryPolicy(3, time.Millisecond, 5*time.Millisecond, 0.5),
+	)
+	callErr := fmt.Errorf("call error")
+	failures := 2
+	calls := 0
+	cb := func() (interface{}, error) {
+		calls++
+		if calls <= failures {
+			return nil, callErr
+		}
+		return calls, nil
+	}
+	// initial call fails twice, and then succeeds
+	val, err := cache.Set("key", cb)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, val)
+	stats := cache.Stats().Keys["key"]
+	assert.Equal(t, uint64(3), stats.Attempts)
+	assert.Equal(t, uint64(2), stats.Retries)
+	// calls keep failing, retry until we run out of attempts
+	failures = 10
+	_, err = cache.Refresh("key")
+	assert.Equal(t, callErr, err)
+	assert.Equal(t, 6, calls)
+	// retries don't exceed the context deadline
+	failures = 0
+	_, err = cache.Set("slow", cb, memoise.SetRetryPolicy(3, time.Second, time.Second, 0))
+	assert.NoError(t, err)
+	failures = 10
+	ctx, cfunc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	start := time.Now()
+	_, err = cache.RefreshCtx(ctx, "slow")
+	cfunc()
+	assert.Equal(t, callErr, err)
+	assert.True(t, time.Since(start) < time.Second)
+	stats = cache.Stats().Keys["slow"]
+	assert.Equal(t, uint64(2), stats.Attempts)
+	assert.Equal(t, uint64(0), stats.Retries)
+	// reads aren't blocked while a refresh is backing off
+	var busy int32
+	_, err = cache.Set("busy", func() (interface{}, error) {
+		if atomic.AddInt32(&busy, 1) > 1 {
+			return nil, callErr
+		}
+		return "busy", nil
+	}, memoise.SetRetryPolicy(3, 200*time.Millisecond, 200*time.Millisecond, 0))
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		_, _ = cache.Refresh("busy")
+		close(done)
+	}()
+	for atomic.LoadInt32(&busy) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	start = time.Now()
+	v, err := cache.Get("busy")
+	assert.NoError(t, err)
+	assert.Equal(t, "busy", v)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	<-done
+	// retries without backoff don't wait for a fake clock
+	cache = memoise.New(
+		memoise.WithClock(clocktest.New(time.Now())),
+		memoise.DefaultRetryPolicy(3, 0, 0, 0),
+	)
+	calls = 0
+	failures = 10
+	_, err = cache.Set("key", cb)
+	assert.Equal(t, callErr, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, uint64(2), cache.Stats().Keys["key"].Retries)
+}
+
+func TestRetryAsync(t *testing.T) {
+	cache := memoise.New(
+		memoise.DefaultTTL(5*time.Millisecond),
+		memoise.DefaultRefreshType(memoise.RefreshAsync),
+		memoise.SetJanitorInterval(10*time.Millisecond),
+	)
+	callErr := fmt.Errorf("call error")
+	var calls int32
+	cb := func() (interface{}, error) {
+		c := atomic.AddInt32(&calls, 1)
+		if c > 1 && c < 4 {
+			return nil, callErr
+		}
+		return c, nil
+	}
+	_, err := cache.Set("key", cb, memoise.SetRetryPolicy(5, time.Millisecond, time.Millisecond, 0))
+	assert.NoError(t, err)
+	// janitor refresh fails twice, then succeeds through background retries
+	for i := 0; i < 100 && cache.Stats().Keys["key"].Retries < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(t, cache.Stats().Keys["key"].Retries >= 2)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(
+		memoise.DefaultTTL(time.Millisecond),
+		memoise.DefaultCacheType(memoise.CacheValueReturnStaleOnError),
+		memoise.WithClock(clock),
+	)
+	callErr := fmt.Errorf("call error")
+	calls := 0
+	fail := false
+	cb := func() (interface{}, error) {
+		calls++
+		if fail {
+			return nil, callErr
+		}
+		return calls, nil
+	}
+	val, err := cache.Set("key", cb, memoise.SetCircuitBreaker(2, 50*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, val)
+	fail = true
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Millisecond)
+		val, err = cache.Get("key")
+		assert.Equal(t, 1, val)
+		assert.Equal(t, callErr, err)
+	}
+	assert.Equal(t, 3, calls)
+	// breaker is open, stale value is returned without calling
+	val, err = cache.Get("key")
+	assert.Equal(t, 1, val)
+	assert.Equal(t, memoise.ErrCircuitOpen, err)
+	assert.Equal(t, 3, calls)
+	// after the cool-down, calls are made again
+	fail = false
+	clock.Advance(50 * time.Millisecond)
+	val, err = cache.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, val)
+}
+
+// halfSource - rand.Source yielding 0.5 for Float64 calls
+type halfSource struct{}
+
+func (halfSource) Int63() int64 {
+	return 1 << 62
+}
+
+func (halfSource) Seed(_ int64) {}
+
+func TestTTLJitter(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(
+		memoise.DefaultTTL(200*time.Millisecond),
+		memoise.TTLJitter(1),
+		memoise.WithRandSource(halfSource{}),
+		memoise.WithClock(clock),
+	)
+	calls := 0
+	cb := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+	// expires after 100ms
+	_, err := cache.Set("jitter", cb)
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Value().Set("jitter", 1))
+	// expires after 200ms
+	_, err = cache.Set("no-jitter", cb, memoise.SetTTLJitter(0))
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Value().Set("no-jitter", 1, memoise.SetTTLJitter(0)))
+	clock.Advance(120 * time.Millisecond)
+	_, err = cache.Value().Get("jitter")
+	assert.Equal(t, memoise.ErrValueExpired, err)
+	_, err = cache.Value().Get("no-jitter")
+	assert.NoError(t, err)
+	val, err := cache.Get("no-jitter")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, val)
+	val, err = cache.Get("jitter")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, val)
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	cache := memoise.New(
+		memoise.DefaultTTL(time.Hour),
+		memoise.WithRandSource(halfSource{}),
+	)
+	calls := 0
+	cb := func() (interface{}, error) {
+		calls++
+		time.Sleep(time.Millisecond)
+		return calls, nil
+	}
+	_, err := cache.Set("regular", cb)
+	assert.NoError(t, err)
+	val, err := cache.Get("regular")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, val)
+	// a huge beta ensures early refresh even though expiry is an hour away
+	_, err = cache.Set("early", cb, memoise.SetEarlyRefresh(1e9))
+	assert.NoError(t, err)
+	val, err = cache.Get("early")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, val)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRefreshAhead(t *testing.T) {
+	cache := memoise.New(memoise.DefaultTTL(100 * time.Millisecond))
+	var calls int32
+	cb := func() (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+	_, err := cache.Set("key", cb, memoise.RefreshAhead(0.5))
+	assert.NoError(t, err)
+	val, err := cache.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), val)
+	time.Sleep(60 * time.Millisecond)
+	// cached value is returned right away, and refreshed in the background
+	val, err = cache.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), val)
+	for i := 0; i < 100 && val == int32(1); i++ {
+		time.Sleep(time.Millisecond)
+		val, err = cache.Get("key")
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), val)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	// errors cached with an error TTL aren't refreshed ahead
+	clock := clocktest.New(time.Now())
+	cache = memoise.New(memoise.WithClock(clock))
+	var errCalls int32
+	_, err = cache.Set("error", func() (interface{}, error) {
+		atomic.AddInt32(&errCalls, 1)
+		return nil, fmt.Errorf("call error")
+	}, memoise.SetTTL(time.Minute), memoise.SetErrorTTL(5*time.Second), memoise.RefreshAhead(0.8))
+	assert.Error(t, err)
+	for i := 0; i < 20; i++ {
+		_, err = cache.Get("error")
+		assert.Error(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&errCalls))
+}
+
+func TestRefreshAsyncServeStale(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(
+		memoise.DefaultRefreshType(memoise.RefreshAsync),
+		memoise.SetJanitorInterval(time.Hour),
+		memoise.WithClock(clock),
+	)
+	var calls, fail int32
+	cb := func() (interface{}, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, fmt.Errorf("call error")
+		}
+		return n, nil
+	}
+	_, err := cache.Set("key", cb, memoise.SetTTL(time.Minute))
+	assert.NoError(t, err)
+	_, err = cache.Set("bounded", cb, memoise.SetTTL(time.Minute), memoise.MaxStale(time.Minute))
+	assert.NoError(t, err)
+	// the janitor fails to refresh the expired values, and won't try again for an hour
+	atomic.StoreInt32(&fail, 1)
+	clock.Advance(90 * time.Second)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	// stale value is returned right away, and refreshed in the background
+	atomic.StoreInt32(&fail, 0)
+	v, err := cache.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), v)
+	for i := 0; i < 100 && v == int32(1); i++ {
+		time.Sleep(time.Millisecond)
+		v, err = cache.Get("key")
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, int32(5), v)
+	// values that are too stale aren't returned, but still refreshed
+	cache.Unset("key")
+	atomic.StoreInt32(&fail, 1)
+	clock.Advance(time.Minute)
+	v, err = cache.Get("bounded")
+	assert.Equal(t, memoise.ErrValueTooStale, err)
+	assert.Nil(t, v)
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 6; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+	assert.Equal(t, uint64(1), cache.Stats().Keys["bounded"].TooStale)
+}
+
+func TestJanitorSchedule(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(
+		memoise.DefaultTTL(10*time.Millisecond),
+		memoise.DefaultRefreshType(memoise.RefreshAsync),
+		memoise.SetJanitorInterval(time.Hour),
+		memoise.WithClock(clock),
+	)
+	calls, otherCalls := 0, 0
+	_, err := cache.Set("async", func() (interface{}, error) {
+		calls++
+		return calls, nil
+	})
+	assert.NoError(t, err)
+	_, err = cache.Set("remove", func() (interface{}, error) {
+		return 1, nil
+	}, memoise.SetRefreshType(memoise.NoRefresh))
+	assert.NoError(t, err)
+	// entry is refreshed when it expires, not when the janitor interval has passed
+	clock.Advance(25 * time.Millisecond)
+	assert.Equal(t, 3, calls)
+	assert.False(t, cache.Has("remove"))
+	// setting the key again replaces the scheduled entry
+	_, err = cache.Set("async", func() (interface{}, error) {
+		otherCalls++
+		return otherCalls, nil
+	})
+	assert.NoError(t, err)
+	clock.Advance(30 * time.Millisecond)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 4, otherCalls)
+	// and unset stops the refreshes
+	cache.Unset("async")
+	clock.Advance(30 * time.Millisecond)
+	assert.Equal(t, 4, otherCalls)
+}
+
+func TestShutdown(t *testing.T) {
+	cache := memoise.New()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	calls := 0
+	_, err := cache.Set("slow", func() (interface{}, error) {
+		calls++
+		if calls > 1 {
+			close(started)
+			<-release
+		}
+		return calls, nil
+	}, memoise.SetTTL(memoise.ValueExpiryNever))
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := cache.Refresh("slow")
+		done <- err
+	}()
+	<-started
+	// deadline passes while the refresh is still running
+	ctx, cfunc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cfunc()
+	assert.Equal(t, context.DeadlineExceeded, cache.Shutdown(ctx))
+	close(release)
+	assert.NoError(t, <-done)
+	// all operations now fail
+	_, err = cache.Get("slow")
+	assert.Equal(t, memoise.ErrCacheClosed, err)
+	_, err = cache.Set("new", func() (interface{}, error) {
+		return 1, nil
+	})
+	assert.Equal(t, memoise.ErrCacheClosed, err)
+	assert.Equal(t, memoise.ErrCacheClosed, cache.Value().Set("val", 1))
+	_, errs := cache.GetMulti([]string{"slow"})
+	assert.Equal(t, memoise.ErrCacheClosed, errs["slow"])
+	// unset after close must not panic
+	cache.Unset("slow")
+	assert.Equal(t, memoise.ErrCacheClosed, cache.Close())
+}
+
+func TestShutdownWaits(t *testing.T) {
+	cache := memoise.New()
+	_, err := cache.Set("key", func() (interface{}, error) {
+		return 1, nil
+	})
+	assert.NoError(t, err)
+	release := make(chan struct{})
+	go func() {
+		_, _ = cache.Set("slow", func() (interface{}, error) {
+			close(release)
+			time.Sleep(20 * time.Millisecond)
+			return 1, nil
+		})
+	}()
+	<-release
+	start := time.Now()
+	assert.NoError(t, cache.Shutdown(context.Background()))
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+}
+
+func TestFunc(t *testing.T) {
+	type query struct {
+		ID     *int
+		Labels map[string]string
+	}
+	cache := memoise.New()
+	calls := 0
+	lookup := memoise.Func(cache, "lookup", func(q query) (string, error) {
+		calls++
+		return fmt.Sprintf("%d-%d", *q.ID, len(q.Labels)), nil
+	})
+	one, other := 1, 1
+	v, err := lookup(query{ID: &one, Labels: map[string]string{"a": "1", "b": "2", "c": "3"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "1-3", v)
+	// pointers are dereferenced, map order doesn't matter
+	v, err = lookup(query{ID: &other, Labels: map[string]string{"c": "3", "b": "2", "a": "1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "1-3", v)
+	assert.Equal(t, 1, calls)
+	two := 2
+	v, err = lookup(query{ID: &two})
+	assert.NoError(t, err)
+	assert.Equal(t, "2-0", v)
+	assert.Equal(t, 2, calls)
+	// arguments that can't be hashed
+	_, err = memoise.Func(cache, "chan", func(ch chan int) (int, error) {
+		return 0, nil
+	})(make(chan int))
+	assert.Equal(t, memoise.ErrUnsupportedArg, err)
+}
+
+func TestFuncKey(t *testing.T) {
+	type args struct {
+		t   time.Time
+		ids []int
+	}
+	// the monotonic clock reading doesn't affect the key, even for unexported fields
+	now := time.Now()
+	k1, err := memoise.FuncKey("x", args{t: now, ids: []int{1}})
+	assert.NoError(t, err)
+	k2, err := memoise.FuncKey("x", args{t: now.Round(0), ids: []int{1}})
+	assert.NoError(t, err)
+	assert.Equal(t, k1, k2)
+	k3, err := memoise.FuncKey("x", map[string]args{"a": {t: now}})
+	assert.NoError(t, err)
+	k4, err := memoise.FuncKey("x", map[string]args{"a": {t: now.Round(0)}})
+	assert.NoError(t, err)
+	assert.Equal(t, k3, k4)
+	// values containing themselves
+	m := map[string]interface{}{}
+	m["self"] = m
+	_, err = memoise.FuncKey("x", m)
+	assert.Equal(t, memoise.ErrUnsupportedArg, err)
+	s := []interface{}{nil}
+	s[0] = s
+	_, err = memoise.FuncKey("x", s)
+	assert.Equal(t, memoise.ErrUnsupportedArg, err)
+	var i interface{}
+	i = &i
+	_, err = memoise.FuncKey("x", i)
+	assert.Equal(t, memoise.ErrUnsupportedArg, err)
+	// shared, but not cyclic
+	shared := []int{1, 2}
+	_, err = memoise.FuncKey("x", [][]int{shared, shared})
+	assert.NoError(t, err)
+}
+
+func TestFuncCtx(t *testing.T) {
+	type ctxKey struct{}
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(memoise.WithClock(clock))
+	calls := 0
+	double := memoise.FuncCtx(cache, "double", func(ctx context.Context, i int) (int, error) {
+		calls++
+		if ctx.Value(ctxKey{}) == nil {
+			return 0, fmt.Errorf("context not passed")
+		}
+		return i * 2, nil
+	}, memoise.SetTTL(time.Second))
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	for i := 0; i < 3; i++ {
+		v, err := double(ctx, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, v)
+	}
+	assert.Equal(t, 1, calls)
+	// entry expires like any other, and is refreshed on access with the given context
+	clock.Advance(2 * time.Second)
+	v, err := double(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, v)
+	assert.Equal(t, 2, calls)
+}
+
+func TestValueCompute(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	vc := memoise.New(memoise.WithClock(clock)).Value()
+	// concurrent read-modify-write
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			_, err := vc.Compute("count", func(old interface{}, exists bool) (interface{}, bool) {
+				if !exists {
+					return 1, true
+				}
+				return old.(int) + 1, true
+			})
+			assert.NoError(t, err)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	v, err := vc.Get("count")
+	assert.NoError(t, err)
+	assert.Equal(t, 50, v)
+	// a slow compute doesn't block other keys
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_, _ = vc.Compute("slow", func(_ interface{}, _ bool) (interface{}, bool) {
+			<-release
+			return 1, true
+		})
+		close(done)
+	}()
+	assert.NoError(t, vc.Set("other", 1))
+	close(release)
+	<-done
+	// removing values
+	_, err = vc.Compute("count", func(_ interface{}, _ bool) (interface{}, bool) {
+		return nil, false
+	})
+	assert.Equal(t, memoise.ErrKeyNotFound, err)
+	assert.False(t, vc.Has("count"))
+	// if absent, if present
+	_, err = vc.ComputeIfPresent("count", func(old interface{}) (interface{}, bool) {
+		return 1, true
+	})
+	assert.Equal(t, memoise.ErrKeyNotFound, err)
+	assert.False(t, vc.Has("count"))
+	v, err = vc.ComputeIfAbsent("count", func() (interface{}, bool) {
+		return 10, true
+	}, memoise.SetTTL(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, v)
+	v, err = vc.ComputeIfAbsent("count", func() (interface{}, bool) {
+		return 20, true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, v)
+	// keep TTL: the value still expires a minute after it was first set
+	clock.Advance(30 * time.Second)
+	v, err = vc.ComputeIfPresent("count", func(old interface{}) (interface{}, bool) {
+		return old.(int) + 1, true
+	}, memoise.SetTTL(time.Minute), memoise.KeepTTL())
+	assert.NoError(t, err)
+	assert.Equal(t, 11, v)
+	clock.Advance(31 * time.Second)
+	_, err = vc.Get("count")
+	assert.Equal(t, memoise.ErrValueExpired, err)
+	// expired values don't exist as far as compute is concerned, the TTL is reset
+	v, err = vc.Compute("count", func(old interface{}, exists bool) (interface{}, bool) {
+		assert.False(t, exists)
+		return 1, true
+	}, memoise.SetTTL(time.Minute), memoise.KeepTTL())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+	clock.Advance(30 * time.Second)
+	_, err = vc.Get("count")
+	assert.NoError(t, err)
+}
+
+func TestValueCounter(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	vc := memoise.New(memoise.WithClock(clock)).Value()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			_, err := vc.Incr("hits", 2)
+			assert.NoError(t, err)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	n, err := vc.Decr("hits", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(39), n)
+	// fixed window: expires a minute after the first hit
+	window := []memoise.EntryConfig{memoise.SetTTL(time.Minute), memoise.KeepTTL()}
+	n, err = vc.Incr("window", 1, window...)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	clock.Advance(40 * time.Second)
+	n, err = vc.Incr("window", 1, window...)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	clock.Advance(30 * time.Second)
+	n, err = vc.Incr("window", 1, window...)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	// sliding: each hit resets the TTL
+	_, _ = vc.Incr("sliding", 1, memoise.SetTTL(time.Minute))
+	clock.Advance(40 * time.Second)
+	_, _ = vc.Incr("sliding", 1, memoise.SetTTL(time.Minute))
+	clock.Advance(30 * time.Second)
+	n, err = vc.Incr("sliding", 1, memoise.SetTTL(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	// other values can't be incremented
+	assert.NoError(t, vc.Set("str", "foo"))
+	_, err = vc.Incr("str", 1)
+	assert.Equal(t, memoise.ErrNotCounter, err)
+	v, err := vc.Get("str")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", v)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cache := memoise.New()
+	vc := cache.Value()
+	assert.NoError(t, vc.Set("config", "a"))
+	v, ver, err := vc.GetWithVersion("config")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", v)
+	// concurrent writer got there first
+	_, other, _ := vc.GetWithVersion("config")
+	assert.NoError(t, vc.CompareAndSwap("config", other, "b"))
+	assert.Equal(t, memoise.ErrVersionMismatch, vc.CompareAndSwap("config", ver, "c"))
+	v, newVer, err := vc.GetWithVersion("config")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", v)
+	assert.True(t, newVer > ver)
+	assert.NoError(t, vc.CompareAndSwap("config", newVer, "c"))
+	assert.Equal(t, memoise.ErrKeyNotFound, vc.CompareAndSwap("missing", newVer, "c"))
+	// call cache values
+	calls := 0
+	_, err = cache.Set("call", func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}, memoise.SetTTL(memoise.ValueExpiryNever))
+	assert.NoError(t, err)
+	v, ver, err = cache.GetWithVersion("call")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+	assert.NoError(t, cache.CompareAndSwap("call", ver, 10))
+	assert.Equal(t, memoise.ErrVersionMismatch, cache.CompareAndSwap("call", ver, 20))
+	v, err = cache.Get("call")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, v)
+	// refreshing changes the version
+	_, ver, _ = cache.GetWithVersion("call")
+	_, err = cache.Refresh("call")
+	assert.NoError(t, err)
+	assert.Equal(t, memoise.ErrVersionMismatch, cache.CompareAndSwap("call", ver, 20))
+}
+
+func TestValueReplaceSwap(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	vc := memoise.New(memoise.WithClock(clock)).Value()
+	assert.Equal(t, memoise.ErrKeyNotFound, vc.Replace("key", 1))
+	assert.False(t, vc.Has("key"))
+	prev, err := vc.Swap("key", 1, memoise.SetTTL(time.Minute))
+	assert.Equal(t, memoise.ErrKeyNotFound, err)
+	assert.Nil(t, prev)
+	assert.NoError(t, vc.Replace("key", 2, memoise.SetTTL(time.Minute)))
+	prev, err = vc.Swap("key", 3, memoise.SetTTL(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, prev)
+	// expired values are not replaced, but are swapped
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, memoise.ErrValueExpired, vc.Replace("key", 4))
+	prev, err = vc.Swap("key", []int{1, 2})
+	assert.Equal(t, memoise.ErrValueExpired, err)
+	assert.Equal(t, 3, prev)
+	// compare and delete
+	assert.False(t, vc.CompareAndDelete("key", []int{1}, nil))
+	assert.True(t, vc.Has("key"))
+	assert.True(t, vc.CompareAndDelete("key", []int{1, 2}, nil))
+	assert.False(t, vc.Has("key"))
+	assert.NoError(t, vc.Set("key", "FOO"))
+	assert.True(t, vc.CompareAndDelete("key", "foo", func(a, b interface{}) bool {
+		return strings.EqualFold(a.(string), b.(string))
+	}))
+	assert.False(t, vc.CompareAndDelete("key", "foo", nil))
+}
+
+func TestExpireAfterAccess(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(memoise.WithClock(clock))
+	vc := cache.Value()
+	assert.NoError(t, vc.Set("session", "data", memoise.SetTTL(memoise.ValueExpiryNever), memoise.ExpireAfterAccess(time.Minute)))
+	assert.NoError(t, vc.Set("capped", "data", memoise.SetTTL(90*time.Second), memoise.ExpireAfterAccess(time.Minute)))
+	// active entries are kept
+	for i := 0; i < 3; i++ {
+		clock.Advance(40 * time.Second)
+		_, err := vc.Get("session")
+		assert.NoError(t, err)
+		if i == 0 {
+			_, err = vc.Get("capped")
+			assert.NoError(t, err)
+		}
+	}
+	// write TTL still applies
+	_, err := vc.Get("capped")
+	assert.Equal(t, memoise.ErrValueExpired, err)
+	// idle entries expire
+	clock.Advance(61 * time.Second)
+	_, err = vc.Get("session")
+	assert.Equal(t, memoise.ErrValueExpired, err)
+	// call cache
+	calls := 0
+	_, err = cache.Set("call", func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}, memoise.SetTTL(memoise.ValueExpiryNever), memoise.ExpireAfterAccess(time.Minute), memoise.SetRefreshType(memoise.NoRefresh))
+	assert.NoError(t, err)
+	clock.Advance(40 * time.Second)
+	v, err := cache.Get("call")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+	clock.Advance(40 * time.Second)
+	assert.True(t, cache.Has("call"))
+	// janitor removes the entry once it's idle for a minute
+	clock.Advance(21 * time.Second)
+	assert.False(t, cache.Has("call"))
+	// idle entries aren't refreshed, they're removed
+	var asyncCalls int32
+	async := func() (interface{}, error) {
+		return atomic.AddInt32(&asyncCalls, 1), nil
+	}
+	_, err = cache.Set("async", async, memoise.SetTTL(memoise.ValueExpiryNever), memoise.ExpireAfterAccess(time.Minute), memoise.SetRefreshType(memoise.RefreshAsync))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Minute)
+	}
+	assert.False(t, cache.Has("async"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&asyncCalls))
+	// refreshes on expiry of the TTL don't keep the entry alive
+	_, err = cache.Set("async", async, memoise.SetTTL(40*time.Second), memoise.ExpireAfterAccess(time.Minute), memoise.SetRefreshType(memoise.RefreshAsync))
+	assert.NoError(t, err)
+	clock.Advance(30 * time.Second)
+	_, err = cache.Get("async")
+	assert.NoError(t, err)
+	// refreshed at 40s and 80s, removed 60s after the last access
+	clock.Advance(55 * time.Second)
+	assert.True(t, cache.Has("async"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&asyncCalls))
+	clock.Advance(5 * time.Second)
+	assert.False(t, cache.Has("async"))
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Minute)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&asyncCalls))
+	// refresh ahead uses the write TTL, not the time left until the entry is idle
+	var aheadCalls int32
+	_, err = cache.Set("ahead", func() (interface{}, error) {
+		return atomic.AddInt32(&aheadCalls, 1), nil
+	}, memoise.SetTTL(time.Minute), memoise.ExpireAfterAccess(10*time.Second), memoise.RefreshAhead(0.8))
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err = cache.Get("ahead")
+		assert.NoError(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&aheadCalls))
+	// kept alive by access, refreshed ahead once 80% of the write TTL has passed
+	for i := 0; i < 10; i++ {
+		clock.Advance(5 * time.Second)
+		_, err = cache.Get("ahead")
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&aheadCalls) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&aheadCalls))
+}
+
+func TestMaxStale(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(memoise.WithClock(clock))
+	fail := false
+	callErr := fmt.Errorf("upstream down")
+	_, err := cache.Set("stale", func() (interface{}, error) {
+		if fail {
+			return nil, callErr
+		}
+		return "value", nil
+	}, memoise.SetTTL(time.Minute), memoise.SetCacheType(memoise.CacheValueReturnStaleOnError), memoise.MaxStale(5*time.Minute))
+	assert.NoError(t, err)
+	fail = true
+	clock.Advance(2 * time.Minute)
+	v, err := cache.Get("stale")
+	assert.Equal(t, callErr, err)
+	assert.Equal(t, "value", v)
+	clock.Advance(5 * time.Minute)
+	v, err = cache.Get("stale")
+	assert.Equal(t, callErr, err)
+	assert.Nil(t, v)
+	assert.Equal(t, uint64(1), cache.Stats().Keys["stale"].TooStale)
+	// recovers once the call succeeds again
+	fail = false
+	v, err = cache.Get("stale")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", v)
+	// explicit refresh
+	_, err = cache.Set("explicit", func() (interface{}, error) {
+		return "value", nil
+	}, memoise.SetTTL(time.Minute), memoise.SetRefreshType(memoise.RefreshExplicit), memoise.MaxStale(time.Minute))
+	assert.NoError(t, err)
+	clock.Advance(90 * time.Second)
+	v, err = cache.Get("explicit")
+	assert.Equal(t, memoise.ErrValueExpired, err)
+	assert.Equal(t, "value", v)
+	clock.Advance(time.Minute)
+	v, err = cache.Get("explicit")
+	assert.Equal(t, memoise.ErrValueTooStale, err)
+	assert.Nil(t, v)
+	assert.Equal(t, uint64(1), cache.Stats().Keys["explicit"].TooStale)
+}
+
+func TestRefreshCall(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(memoise.WithClock(clock))
+	var prevs []interface{}
+	modified := false
+	v, err := cache.SetRefreshCall("etag", func(_ context.Context, prev interface{}, prevErr error) (interface{}, error) {
+		prevs = append(prevs, prev)
+		if prev != nil && !modified {
+			return nil, memoise.ErrNotModified
+		}
+		return fmt.Sprintf("value %d", len(prevs)), nil
+	}, memoise.SetTTL(time.Minute), memoise.SetRefreshType(memoise.RefreshOnAccess))
+	assert.NoError(t, err)
+	assert.Equal(t, "value 1", v)
+	_, ver, err := cache.GetWithVersion("etag")
+	assert.NoError(t, err)
+	clock.Advance(2 * time.Minute)
+	// value is kept, and valid for another TTL
+	v, err = cache.Get("etag")
+	assert.NoError(t, err)
+	assert.Equal(t, "value 1", v)
+	_, same, err := cache.GetWithVersion("etag")
+	assert.NoError(t, err)
+	assert.Equal(t, ver, same)
+	clock.Advance(30 * time.Second)
+	v, err = cache.Get("etag")
+	assert.NoError(t, err)
+	assert.Equal(t, "value 1", v)
+	assert.Equal(t, []interface{}{nil, "value 1"}, prevs)
+	modified = true
+	v, err = cache.Refresh("etag")
+	assert.NoError(t, err)
+	assert.Equal(t, "value 3", v)
+	assert.Equal(t, []interface{}{nil, "value 1", "value 1"}, prevs)
+	_, newVer, _ := cache.GetWithVersion("etag")
+	assert.NotEqual(t, ver, newVer)
+}
+
+func TestWatch(t *testing.T) {
+	clock := clocktest.New(time.Now())
+	cache := memoise.New(memoise.WithClock(clock))
+	next := func(ch <-chan memoise.Event) memoise.Event {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+		return memoise.Event{}
+	}
+	flag, stop := cache.Watch("feature.x")
+	all, stopAll := cache.WatchPrefix("feature.")
+	defer stopAll()
+	// never reads, must not block anything
+	slow, stopSlow := cache.WatchPrefix("")
+	defer stopSlow()
+	enabled := false
+	_, err := cache.Set("feature.x", func() (interface{}, error) {
+		return enabled, nil
+	}, memoise.SetTTL(time.Minute))
+	assert.NoError(t, err)
+	_, err = cache.Set("other", func() (interface{}, error) {
+		return 1, nil
+	})
+	assert.NoError(t, err)
+	ev := next(flag)
+	assert.Equal(t, memoise.Event{Key: "feature.x", New: false, Cause: memoise.CauseSet}, ev)
+	assert.Equal(t, ev, next(all))
+	enabled = true
+	_, err = cache.Refresh("feature.x")
+	assert.NoError(t, err)
+	assert.Equal(t, memoise.Event{Key: "feature.x", Old: false, New: true, Cause: memoise.CauseRefresh}, next(flag))
+	cache.Unset("feature.x")
+	assert.Equal(t, memoise.Event{Key: "feature.x", Old: true, Cause: memoise.CauseUnset}, next(flag))
+	stop()
+	_, ok := <-flag
+	assert.False(t, ok)
+	// janitor removes expired entries
+	_, err = cache.Set("feature.y", func() (interface{}, error) {
+		return "y", nil
+	}, memoise.SetTTL(time.Minute), memoise.SetRefreshType(memoise.NoRefresh))
+	assert.NoError(t, err)
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, memoise.CauseRefresh, next(all).Cause)
+	assert.Equal(t, memoise.CauseUnset, next(all).Cause)
+	assert.Equal(t, memoise.Event{Key: "feature.y", New: "y", Cause: memoise.CauseSet}, next(all))
+	assert.Equal(t, memoise.Event{Key: "feature.y", Old: "y", Cause: memoise.CauseExpired}, next(all))
+	assert.Equal(t, memoise.Event{Key: "feature.x", New: false, Cause: memoise.CauseSet}, next(slow))
+	// swapping the value
+	_, err = cache.Set("feature.z", func() (interface{}, error) {
+		return "off", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, memoise.CauseSet, next(all).Cause)
+	_, ver, err := cache.GetWithVersion("feature.z")
+	assert.NoError(t, err)
+	assert.NoError(t, cache.CompareAndSwap("feature.z", ver, "on"))
+	assert.Equal(t, memoise.Event{Key: "feature.z", Old: "off", New: "on", Cause: memoise.CauseSet}, next(all))
+	// queues are bounded, once full events are merged, the last value is always delivered
+	flood, stopFlood := cache.Watch("flood")
+	defer stopFlood()
+	for i := 0; i < 2000; i++ {
+		n := i
+		_, err = cache.Set("flood", func() (interface{}, error) {
+			return n, nil
+		})
+		assert.NoError(t, err)
+	}
+	received, dropped := 0, uint64(0)
+	for ev := next(flood); ; ev = next(flood) {
+		received++
+		dropped += ev.Dropped
+		if ev.New == 1999 {
+			break
+		}
+	}
+	assert.Equal(t, 2000, received+int(dropped))
+	assert.True(t, dropped > 0)
+	// events are queued in the order the entry was written, the last event has the cached value
+	order, stopOrder := cache.Watch("order")
+	defer stopOrder()
+	var n int32
+	_, err = cache.Set("order", func() (interface{}, error) {
+		return atomic.AddInt32(&n, 1), nil
+	})
+	assert.NoError(t, err)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			_, err := cache.Refresh("order")
+			assert.NoError(t, err)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	var last memoise.Event
+	for i := 0; i < 51; i++ {
+		last = next(order)
+	}
+	v, err := cache.Get("order")
+	assert.NoError(t, err)
+	assert.Equal(t, v, last.New)
+	// closing the cache stops all watchers
+	assert.NoError(t, cache.Close())
+	for range all {
+	}
+}
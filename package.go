@@ -3,6 +3,7 @@ package memoise
 import (
 	"context"
 	"errors"
+	"math/rand"
 	"time"
 )
 
@@ -13,6 +14,23 @@ var (
 	ErrDuplicateEntry = errors.New("cache already contains key")
 	// ErrKeyNotFound - error returned when getting a key that hasn't been cached
 	ErrKeyNotFound = errors.New("cache does not contain given key")
+	// ErrDependencyCycle - error returned by Set when DependsOn would create a dependency cycle
+	ErrDependencyCycle = errors.New("entry dependencies form a cycle")
+	// ErrCircuitOpen - error returned instead of making a call while the entry circuit breaker is open
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+	// ErrCacheClosed - error returned by all operations once the cache has been closed
+	ErrCacheClosed = errors.New("cache is closed")
+	// ErrUnsupportedArg - error returned by memoised functions if the argument can't be used as a key
+	// (e.g. it contains channels, functions, or pointer cycles)
+	ErrUnsupportedArg = errors.New("argument can not be used as cache key")
+	// ErrNotCounter - error returned by Incr and Decr if the key holds a value other than an int64
+	ErrNotCounter = errors.New("value is not an int64 counter")
+	// ErrVersionMismatch - error returned by CompareAndSwap if the value was changed since the version was obtained
+	ErrVersionMismatch = errors.New("value version does not match")
+	// ErrValueTooStale - error returned instead of a stale value that has been expired for longer than MaxStale
+	ErrValueTooStale = errors.New("the cache value is too stale")
+	// ErrNotModified - returned by a RefreshCall to keep the previous value, and extend its expiry
+	ErrNotModified = errors.New("value not modified")
 )
 
 const (
@@ -29,7 +47,7 @@ const (
 	// RefreshOnAccess - should the cached values be expired, refresh ad-hoc
 	RefreshOnAccess RefreshType = iota
 	// RefreshAsync - do not attempt refresh on access, but leave it to the cache manager
-	// getting values from cache might result in blocking calls as a result, use with caution
+	// getting an expired value returns the stale value, and refreshes it in the background
 	RefreshAsync
 	// RefreshExplicit - Never refresh automatically, stale values are returned along with ValueExpiredErr
 	// error. Cache will not be refreshed until an explicit refresh call is made. This call is blocking
@@ -54,16 +72,43 @@ const (
 )
 
 const (
-	// DefaultJanitorInterval - Default tick duration for janitor to clean the cache
-	// this only clears out the call-cache!
+	// DefaultJanitorInterval - Default interval at which the janitor tries again to refresh entries
+	// when a refresh failed (and no retry policy applies). Entries are refreshed or removed as soon
+	// as they expire. The janitor only manages the call-cache!
 	DefaultJanitorInterval = time.Minute
 	// TTLJanitorInterval - Set Janitor interval to equal to items TTL
 	TTLJanitorInterval time.Duration = 0
 )
 
+const (
+	// CauseSet - the entry was set, or loaded
+	CauseSet EventCause = iota
+	// CauseRefresh - the value was refreshed, explicitly, on access, or ahead of expiry
+	CauseRefresh
+	// CauseAutoRefresh - the value was refreshed by the janitor
+	CauseAutoRefresh
+	// CauseExpired - the entry was removed because it expired
+	CauseExpired
+	// CauseUnset - the entry was removed using Unset
+	CauseUnset
+)
+
+// DefaultBatchWindow - Default time GetMulti waits for concurrent requests to merge into a single BatchCall
+const DefaultBatchWindow = time.Millisecond
+
 // Call - function yielding return value + error, these values will be the ones cached
 type Call func() (interface{}, error)
 
+// RefreshCall - call receiving the previous value and error, return ErrNotModified to keep the previous value
+type RefreshCall func(ctx context.Context, prev interface{}, prevErr error) (interface{}, error)
+
+// Loader - function loading the value for any given key, used by read-through caches
+type Loader func(ctx context.Context, key string) (interface{}, error)
+
+// BatchCall - function loading multiple keys in one go, keys missing from both maps are considered not found
+// and are not cached
+type BatchCall func(keys []string) (map[string]interface{}, map[string]error)
+
 // EntryConfig - Type to override default config for a specific entry (used as varargs in Set func)
 type EntryConfig func(cacheItem)
 
@@ -79,22 +124,76 @@ type RefreshType int
 // DuplicateCheck - check if given cache entry already exists before setting (check not performed by default)
 type DuplicateCheck int
 
+// EventCause - what caused the change an Event reports
+type EventCause int
+
 // Cache - exposed interface of the package
 type Cache interface {
 	// Set - Add new entry to cachj
 	Set(key string, call Call, opts ...EntryConfig) (interface{}, error)
 	// Refresh - Explicit refresh for given value (blocking)
 	Refresh(key string) (interface{}, error)
+	// RefreshCtx - Explicit refresh, failing calls are retried within the context deadline
+	RefreshCtx(ctx context.Context, key string) (interface{}, error)
 	// Has - check if given key exist
 	Has(key string) bool
 	// CAS - Check And Set, check for duplicate prior to setting value
 	CAS(key string, call Call, opts ...EntryConfig) (interface{}, error)
-	// Get - Get cached values
+	// Get - Get cached values, with a Loader configured, unknown keys are loaded
 	Get(key string) (interface{}, error)
+	// GetCtx - Get cached values, refreshing or loading values within the context deadline
+	GetCtx(ctx context.Context, key string) (interface{}, error)
+	// GetMulti - Get multiple cached values, misses and expired keys are loaded using the BatchCall
+	GetMulti(keys []string) (map[string]interface{}, map[string]error)
 	// Unset - Remove given entry from cache
 	Unset(key string)
 	// Value - access simple key - value cache
 	Value() ValueCache
+	// SetRefreshCall - Set, using a call that gets the previous value on refresh
+	SetRefreshCall(key string, call RefreshCall, opts ...EntryConfig) (interface{}, error)
+	// Stats - get a snapshot of the cache statistics
+	Stats() Stats
+	// GetWithVersion - get the cached value and its version, to be passed to CompareAndSwap
+	GetWithVersion(key string) (interface{}, uint64, error)
+	// CompareAndSwap - replace the cached value, only if it wasn't changed since version was obtained
+	CompareAndSwap(key string, version uint64, value interface{}) error
+	// Close - stop background work and cancel running calls, further operations return ErrCacheClosed
+	Close() error
+	// Shutdown - stop background work and wait for running calls until the context is done
+	// further operations return ErrCacheClosed
+	Shutdown(ctx context.Context) error
+	// Watch - get change events for the key, the returned func stops watching and closes the channel
+	// events are queued for each watcher, so slow watchers don't block the cache. Events are sent when
+	// the value is set, refreshed, swapped, or the entry is removed (Unset, or NoRefresh expiry)
+	// expiry of other entries, invalidation through DependsOn, and the value cache don't send events
+	Watch(key string) (<-chan Event, func())
+	// WatchPrefix - Watch all keys starting with the given prefix
+	WatchPrefix(prefix string) (<-chan Event, func())
+}
+
+// Event - change to a call-cache entry, as delivered to watchers
+type Event struct {
+	Key   string
+	Old   interface{} // previous value, nil for new entries
+	New   interface{} // new value, nil if the entry was removed
+	Err   error       // error cached along with the new value
+	Cause EventCause
+	// Dropped - number of events dropped, or merged into others, since the previous event was delivered
+	// events are queued for each watcher, once 1024 events are queued, new ones are merged into the last
+	// event for the same key, or dropped if there is none
+	Dropped uint64
+}
+
+// Stats - snapshot of cache statistics
+type Stats struct {
+	Keys map[string]KeyStats // stats per call-cache entry
+}
+
+// KeyStats - statistics for a single call-cache entry
+type KeyStats struct {
+	Attempts uint64 // number of times the call was made, including retries
+	Retries  uint64 // number of calls made to retry a failed call
+	TooStale uint64 // number of times the stale value wasn't returned, because it exceeded MaxStale
 }
 
 // ValueCache - interface for cache - similar to callback-based cache
@@ -106,14 +205,51 @@ type ValueCache interface {
 	Has(key string) bool
 	CAS(key string, value interface{}, opts ...EntryConfig) (interface{}, error)
 	Unset(key string)
+	// Compute - atomically replace the value for key with the result of fn, see ComputeFunc
+	// fn is called with the key locked, using the same key from within fn (Get, Set, Incr, ...) deadlocks
+	Compute(key string, fn ComputeFunc, opts ...EntryConfig) (interface{}, error)
+	// ComputeIfAbsent - atomically set key to the result of fn, only if key isn't set, or has expired
+	// fn is called with the key locked, don't use the same key from within fn, see Compute
+	ComputeIfAbsent(key string, fn func() (interface{}, bool), opts ...EntryConfig) (interface{}, error)
+	// ComputeIfPresent - atomically replace the value for key with the result of fn, only if key is set
+	// fn is called with the key locked, don't use the same key from within fn, see Compute
+	ComputeIfPresent(key string, fn func(old interface{}) (interface{}, bool), opts ...EntryConfig) (interface{}, error)
+	// Incr - atomically increment an int64 counter, creating it if needs be
+	Incr(key string, delta int64, opts ...EntryConfig) (int64, error)
+	// Decr - atomically decrement an int64 counter, creating it if needs be
+	Decr(key string, delta int64, opts ...EntryConfig) (int64, error)
+	// GetWithVersion - get the value and its version, to be passed to CompareAndSwap
+	GetWithVersion(key string) (interface{}, uint64, error)
+	// CompareAndSwap - set the value, only if it wasn't changed since version was obtained
+	CompareAndSwap(key string, version uint64, value interface{}, opts ...EntryConfig) error
+	// Replace - set the value, only if the key is set and hasn't expired
+	Replace(key string, value interface{}, opts ...EntryConfig) error
+	// Swap - set the value, and return the previous one
+	Swap(key string, value interface{}, opts ...EntryConfig) (interface{}, error)
+	// CompareAndDelete - unset key if its value equals expected according to eq (reflect.DeepEqual if nil)
+	CompareAndDelete(key string, expected interface{}, eq func(a, b interface{}) bool) bool
 }
 
+// ComputeFunc - compute a new value from the current one (exists is false if not set, or expired)
+// return false to remove the key
+type ComputeFunc func(old interface{}, exists bool) (interface{}, bool)
+
 // cacheItem - interface for both centry and vcentry
 // so they can be configured using the EntryConfig args
 type cacheItem interface {
 	setTTL(ttl time.Duration)
+	setErrTTL(ttl time.Duration)
+	setRetry(p retryPolicy)
+	setBreaker(b breakerConf)
+	setJitter(fraction float64)
+	setEarlyRefresh(beta float64)
+	setRefreshAhead(fraction float64)
 	setCT(ct CacheType)
 	SetRefreshType(rt RefreshType)
+	setDeps(keys []string)
+	setKeepTTL(keep bool)
+	setIdle(d time.Duration)
+	setMaxStale(d time.Duration)
 }
 
 // DefaultTTL - Set cache-level default TTL
@@ -123,6 +259,53 @@ func DefaultTTL(ttl time.Duration) CacheConf {
 	}
 }
 
+// DefaultErrorTTL - Set cache-level default TTL for errors returned by calls (negative caching)
+// errors are then kept for the given duration, regardless of cache type. Defaults to 0 (disabled)
+func DefaultErrorTTL(ttl time.Duration) CacheConf {
+	return func(c *cache) {
+		c.defaultErrTTL = ttl
+	}
+}
+
+// DefaultRetryPolicy - Set cache-level retry policy for failing calls, see SetRetryPolicy
+func DefaultRetryPolicy(maxAttempts int, baseDelay, maxDelay time.Duration, jitter float64) CacheConf {
+	return func(c *cache) {
+		c.defaultRetry = newRetryPolicy(maxAttempts, baseDelay, maxDelay, jitter)
+	}
+}
+
+// DefaultCircuitBreaker - Set cache-level circuit breaker, see SetCircuitBreaker
+func DefaultCircuitBreaker(threshold int, coolDown time.Duration) CacheConf {
+	return func(c *cache) {
+		c.defaultBreaker = breakerConf{
+			threshold: threshold,
+			coolDown:  coolDown,
+		}
+	}
+}
+
+// TTLJitter - Set cache-level TTL jitter: each expiry is reduced by a random fraction (0-1) of the TTL
+// so entries created at the same time don't all expire at the same time
+func TTLJitter(fraction float64) CacheConf {
+	return func(c *cache) {
+		c.defaultJitter = fraction
+	}
+}
+
+// WithRandSource - Set the source of randomness used for TTL jitter, mainly useful for testing
+func WithRandSource(src rand.Source) CacheConf {
+	return func(c *cache) {
+		c.rnd = newLockedRand(src)
+	}
+}
+
+// WithClock - Set the clock used for expiry, refreshes and timers, the default uses the time package
+func WithClock(clock Clock) CacheConf {
+	return func(c *cache) {
+		c.clock = clock
+	}
+}
+
 // DefaultDuplicateCheck - Set default behaviours on calling "Set"
 func DefaultDuplicateCheck(dc DuplicateCheck) CacheConf {
 	return func(c *cache) {
@@ -144,13 +327,36 @@ func DefaultRefreshType(rt RefreshType) CacheConf {
 	}
 }
 
-// SetJanitorInterval - custom janitor interval, defaults to 1 minute
+// SetJanitorInterval - custom janitor retry interval for failed refreshes, defaults to 1 minute
 func SetJanitorInterval(cycle time.Duration) CacheConf {
 	return func(c *cache) {
 		c.jCycle = cycle
 	}
 }
 
+// WithLoader - make the cache read-through: getting an unknown key adds it using the loader
+// with the default cache settings. The loader is used to refresh the entry, too
+func WithLoader(l Loader) CacheConf {
+	return func(c *cache) {
+		c.loader = l
+	}
+}
+
+// WithBatchCall - Set the call used by GetMulti to load missing and expired keys
+func WithBatchCall(bc BatchCall) CacheConf {
+	return func(c *cache) {
+		c.batch = newBatcher(c, bc)
+	}
+}
+
+// BatchWindow - time GetMulti waits for concurrent requests before calling BatchCall, defaults to 1ms
+// the window uses the actual time, even if the cache uses a different Clock
+func BatchWindow(window time.Duration) CacheConf {
+	return func(c *cache) {
+		c.bWindow = window
+	}
+}
+
 // SetCacheType - Override cache-type on entry level
 func SetCacheType(ct CacheType) EntryConfig {
 	return func(e cacheItem) {
@@ -172,6 +378,97 @@ func SetTTL(ttl time.Duration) EntryConfig {
 	}
 }
 
+// SetErrorTTL - override error TTL on entry level. For CacheValueReturnStaleOnError, the stale value
+// is returned along with the error for the duration of the error TTL
+func SetErrorTTL(ttl time.Duration) EntryConfig {
+	return func(e cacheItem) {
+		e.setErrTTL(ttl)
+	}
+}
+
+// SetRetryPolicy - retry failing calls up to maxAttempts times (including the initial call)
+// the delay between attempts doubles, starting at baseDelay, up to maxDelay. Jitter (0-1) is the fraction
+// by which each delay is randomly reduced. Calls made by the janitor are retried in the background
+// all other calls are retried before returning, provided the context deadline allows for it
+// backoff uses the cache Clock, so with a fake clock and a baseDelay > 0, the caller blocks until the clock
+// is advanced from another goroutine
+func SetRetryPolicy(maxAttempts int, baseDelay, maxDelay time.Duration, jitter float64) EntryConfig {
+	return func(e cacheItem) {
+		e.setRetry(newRetryPolicy(maxAttempts, baseDelay, maxDelay, jitter))
+	}
+}
+
+// SetCircuitBreaker - stop making calls after threshold consecutive failures. Once the cool-down has passed
+// a single call is let through, if it succeeds, calls are made again. While the breaker is open
+// ErrCircuitOpen is returned, along with the stale value for CacheValueReturnStaleOnError entries
+func SetCircuitBreaker(threshold int, coolDown time.Duration) EntryConfig {
+	return func(e cacheItem) {
+		e.setBreaker(breakerConf{
+			threshold: threshold,
+			coolDown:  coolDown,
+		})
+	}
+}
+
+// SetTTLJitter - override TTL jitter on entry level
+func SetTTLJitter(fraction float64) EntryConfig {
+	return func(e cacheItem) {
+		e.setJitter(fraction)
+	}
+}
+
+// SetEarlyRefresh - probabilistic early refresh (XFetch) for RefreshOnAccess entries. Get refreshes the value
+// ahead of expiry with a probability that increases as expiry nears, and with the duration of the call
+// beta scales the probability, 1 is a sensible default, higher values refresh earlier. Values are
+// refreshed by a single request, concurrent requests keep getting the cached value in the mean time
+func SetEarlyRefresh(beta float64) EntryConfig {
+	return func(e cacheItem) {
+		e.setEarlyRefresh(beta)
+	}
+}
+
+// RefreshAhead - once a value is older than the given fraction of its TTL (e.g. 0.8), Get returns the cached
+// value, and refreshes it in the background. Applies to RefreshOnAccess and RefreshAsync entries
+func RefreshAhead(fraction float64) EntryConfig {
+	return func(e cacheItem) {
+		e.setRefreshAhead(fraction)
+	}
+}
+
+// DependsOn - declare the keys an entry is derived from. Whenever one of these keys is
+// set, refreshed, or unset, the entry (and anything depending on it) is invalidated
+func DependsOn(keys ...string) EntryConfig {
+	return func(e cacheItem) {
+		e.setDeps(keys)
+	}
+}
+
+// ExpireAfterAccess - values expire once they haven't been accessed (Get) for the given duration
+// combined with a TTL, the value expires once either of them has passed. Idle entries are removed
+// (RefreshAsync and NoRefresh), janitor refreshes don't count as access
+func ExpireAfterAccess(d time.Duration) EntryConfig {
+	return func(e cacheItem) {
+		e.setIdle(d)
+	}
+}
+
+// MaxStale - hard limit on how long after expiry a stale value can be returned
+// (CacheValueReturnStaleOnError, RefreshExplicit, RefreshAsync). Past this, the call error, or
+// ErrValueTooStale, is returned without a value. Only applies to call-cache entries
+func MaxStale(d time.Duration) EntryConfig {
+	return func(e cacheItem) {
+		e.setMaxStale(d)
+	}
+}
+
+// KeepTTL - when updating a value that hasn't expired yet, keep its expiry rather than resetting it
+// only applies to the value cache (Compute and friends, Incr and Decr)
+func KeepTTL() EntryConfig {
+	return func(e cacheItem) {
+		e.setKeepTTL(true)
+	}
+}
+
 // New - get new cache object
 func New(opts ...CacheConf) Cache {
 	return NewCtx(context.Background(), opts...)
@@ -183,7 +480,13 @@ func NewCtx(ctx context.Context, opts ...CacheConf) Cache {
 		o(c)
 	}
 	c.vCache.defaultTTL = c.defaultTTL
+	c.vCache.defaultJitter = c.defaultJitter
+	c.vCache.rnd = c.rnd
+	c.vCache.clock = c.clock
 	c.vCache.checkDuplicates = c.checkDuplicates
+	if c.batch != nil {
+		c.batch.window = c.bWindow
+	}
 	// we have to start the janitor after setting the config correctly
 	c.startJanitor()
 	return c
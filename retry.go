@@ -0,0 +1,127 @@
+package memoise
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+	jitter   float64
+}
+
+func newRetryPolicy(attempts int, base, max time.Duration, jitter float64) retryPolicy {
+	if max < base {
+		max = base
+	}
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	return retryPolicy{
+		attempts: attempts,
+		base:     base,
+		max:      max,
+		jitter:   jitter,
+	}
+}
+
+// backoff - get delay before making the given attempt (first retry is attempt 1)
+func (p retryPolicy) backoff(attempt int, rnd *lockedRand) time.Duration {
+	d := p.base
+	for i := 1; i < attempt && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	if p.jitter > 0 {
+		d -= time.Duration(float64(d) * p.jitter * rnd.Float64())
+	}
+	return d
+}
+
+// call - make the call, retrying failures in the foreground until the policy or context deadline says otherwise
+// prev and prevErr are the currently cached value and error, passed to RefreshCall callbacks
+func (e *centry) call(ctx context.Context, prev interface{}, prevErr error) (interface{}, error) {
+	v, err := e.invoke(ctx, prev, prevErr)
+	for attempt := 1; e.retryable(err, attempt); attempt++ {
+		if !e.wait(ctx, attempt) {
+			return v, err
+		}
+		v, err = e.invoke(ctx, prev, prevErr)
+	}
+	return v, err
+}
+
+// retryable - returns true if the given attempt should be made after the call failed with err
+func (e *centry) retryable(err error, attempt int) bool {
+	return err != nil && err != ErrCircuitOpen && err != ErrNotModified && attempt < e.retry.attempts
+}
+
+// wait - back off before making the given attempt, returns false if the context is done before that
+func (e *centry) wait(ctx context.Context, attempt int) bool {
+	d := e.retry.backoff(attempt, e.rnd)
+	// context deadlines use the actual time
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < d {
+		return false
+	}
+	if d <= 0 {
+		// no backoff, don't depend on the clock firing timers
+		if ctx.Err() != nil {
+			return false
+		}
+		atomic.AddUint64(&e.retries, 1)
+		return true
+	}
+	ch := make(chan struct{})
+	t := e.clock.AfterFunc(d, func() {
+		close(ch)
+	})
+	select {
+	case <-ctx.Done():
+		t.Stop()
+		return false
+	case <-ch:
+	}
+	atomic.AddUint64(&e.retries, 1)
+	return true
+}
+
+// invoke - make a single call, unless the circuit breaker is open
+func (e *centry) invoke(ctx context.Context, prev interface{}, prevErr error) (interface{}, error) {
+	if !e.br.allow() {
+		return nil, ErrCircuitOpen
+	}
+	atomic.AddUint64(&e.attempts, 1)
+	start := e.clock.Now()
+	var (
+		v   interface{}
+		err error
+	)
+	if e.rcb != nil {
+		v, err = e.rcb(ctx, prev, prevErr)
+	} else {
+		v, err = e.cb(ctx)
+	}
+	atomic.StoreInt64(&e.delta, int64(e.clock.Now().Sub(start)))
+	if err == ErrNotModified {
+		// the call was successful, the previous value is still valid
+		e.br.done(nil)
+		return prev, err
+	}
+	e.br.done(err)
+	return v, err
+}
+
+func (e *centry) stats() KeyStats {
+	return KeyStats{
+		Attempts: atomic.LoadUint64(&e.attempts),
+		Retries:  atomic.LoadUint64(&e.retries),
+		TooStale: atomic.LoadUint64(&e.tooStale),
+	}
+}
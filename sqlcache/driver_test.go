@@ -0,0 +1,148 @@
+package sqlcache_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// fakeDriver - minimal driver, a single users table (id, name), and a handful of known statements
+type fakeDriver struct {
+	mu      sync.Mutex
+	users   [][]driver.Value
+	queries int32
+}
+
+func newFakeDB(d *fakeDriver) *sql.DB {
+	return sql.OpenDB(d)
+}
+
+// Connect - implement driver.Connector
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+// Driver - implement driver.Connector
+func (d *fakeDriver) Driver() driver.Driver {
+	return d
+}
+
+// Open - implement driver.Driver
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+func (d *fakeDriver) queryCount() int32 {
+	return atomic.LoadInt32(&d.queries)
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{d: c.d, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return strings.Count(s.query, "?")
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	switch s.query {
+	case "INSERT INTO users (id, name) VALUES (?, ?)":
+		s.d.users = append(s.d.users, []driver.Value{args[0], args[1]})
+	case "UPDATE users SET name = ? WHERE id = ?":
+		for _, u := range s.d.users {
+			if u[0] == args[1] {
+				u[1] = args[0]
+			}
+		}
+	default:
+		s.d.mu.Unlock()
+		return nil, errors.New("unsupported statement: " + s.query)
+	}
+	s.d.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	atomic.AddInt32(&s.d.queries, 1)
+	s.d.mu.Lock()
+	var rows [][]driver.Value
+	switch s.query {
+	case "SELECT id, name FROM users":
+		for _, u := range s.d.users {
+			rows = append(rows, []driver.Value{u[0], u[1]})
+		}
+	case "SELECT u.id, u.name FROM users u, orders AS o WHERE o.user_id = u.id", "SELECT id, name FROM users, unnest(?, ?)":
+		for _, u := range s.d.users {
+			rows = append(rows, []driver.Value{u[0], u[1]})
+		}
+	case "DELETE FROM users WHERE id = ? RETURNING id, name":
+		users := s.d.users[:0]
+		for _, u := range s.d.users {
+			if u[0] == args[0] {
+				rows = append(rows, []driver.Value{u[0], u[1]})
+			} else {
+				users = append(users, u)
+			}
+		}
+		s.d.users = users
+	case "SELECT id, name FROM users WHERE id = ?", "SELECT id, name FROM users WHERE id = ? FOR UPDATE":
+		for _, u := range s.d.users {
+			if u[0] == args[0] {
+				rows = append(rows, []driver.Value{u[0], u[1]})
+			}
+		}
+	default:
+		s.d.mu.Unlock()
+		return nil, errors.New("unsupported query: " + s.query)
+	}
+	s.d.mu.Unlock()
+	return &fakeRows{rows: rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"id", "name"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
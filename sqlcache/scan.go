@@ -0,0 +1,106 @@
+package sqlcache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// QueryStructs - QueryContext, scanning the rows into structs of type T
+// columns are matched to fields using the db tag, or the field name (case insensitive)
+// columns without a matching field are ignored
+func QueryStructs[T any](ctx context.Context, c *Cache, query string, args ...interface{}) ([]T, error) {
+	rows, err := c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return Scan[T](rows)
+}
+
+// Scan - scan rows into structs of type T
+func Scan[T any](rows []Row) ([]T, error) {
+	out := make([]T, len(rows))
+	if len(rows) == 0 {
+		return out, nil
+	}
+	t := reflect.TypeOf(out).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("sqlcache: can't scan into %s, not a struct", t)
+	}
+	fields := fieldIndex(t)
+	for i, r := range rows {
+		v := reflect.ValueOf(&out[i]).Elem()
+		for col, val := range r {
+			idx, ok := fields[strings.ToLower(col)]
+			if !ok {
+				continue
+			}
+			if err := assign(v.Field(idx), val); err != nil {
+				return nil, fmt.Errorf("sqlcache: column %s: %v", col, err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// fieldIndex - lower case column name -> field index
+func fieldIndex(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("db"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		fields[strings.ToLower(name)] = i
+	}
+	return fields
+}
+
+// assign - set the field to the column value, converting between compatible types
+func assign(f reflect.Value, val interface{}) error {
+	if val == nil {
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+	if f.Kind() == reflect.Ptr {
+		p := reflect.New(f.Type().Elem())
+		if err := assign(p.Elem(), val); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	}
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(f.Type()) {
+		f.Set(v)
+		return nil
+	}
+	if b, ok := val.([]byte); ok && f.Kind() == reflect.String {
+		f.SetString(string(b))
+		return nil
+	}
+	if numeric(v.Kind()) && numeric(f.Kind()) {
+		f.Set(v.Convert(f.Type()))
+		return nil
+	}
+	return fmt.Errorf("can't assign %T to %s", val, f.Type())
+}
+
+func numeric(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+// Package sqlcache caches the results of read-only queries in a memoise.Cache
+//
+// Query results are materialised, and keyed by the query text and arguments. Results are tagged
+// with the tables the query reads from, statements run through ExecContext invalidate the results
+// tagged with the tables they write to. Table names are extracted from the SQL text, this is
+// deliberately simple: FROM (including comma separated lists), JOIN, INTO, UPDATE, and TABLE
+// clauses are recognised, views and functions are not. Statements where no table can be found
+// invalidate all cached results, results of queries where no table can be found are invalidated
+// by all statements. Only SELECT and WITH queries are cached, queries writing to tables (e.g. DELETE ...
+// RETURNING) or locking rows (SELECT ... FOR UPDATE) are run every time, and invalidate like ExecContext.
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/EVODelavega/go-memoise"
+)
+
+const (
+	keyName = "sqlcache"
+	// minPrune - number of tagged keys before removed entries are pruned from the tags
+	minPrune = 64
+)
+
+var (
+	tableRE = regexp.MustCompile("(?i)\\b(?:from|join|into|update|table)\\s+([`\"\\[]?[\\w.]+)")
+	// fromRE - FROM clause, up to the next clause
+	fromRE = regexp.MustCompile("(?is)\\bfrom\\s+(.*?)(?:\\b(?:where|join|inner|left|right|full|cross|natural|on|using|group|order|having|limit|union|window|for|returning)\\b|[;)]|$)")
+	// fromItemRE - table in a FROM list, with an optional alias
+	fromItemRE = regexp.MustCompile("(?i)^([`\"\\[]?[\\w.]+[`\"\\]]?)(?:\\s+(?:as\\s+)?\\w+)?$")
+	// writeRE - clauses writing to, or locking tables
+	writeRE = regexp.MustCompile("(?i)\\b(?:insert|update|delete|merge|into|returning|for\\s+(?:no\\s+key\\s+update|share|key\\s+share)|lock\\s+in\\s+share\\s+mode)\\b")
+)
+
+// DB - the methods of *sql.DB used, a *sql.Conn can be used, too
+// don't use a *sql.Tx, the cache is shared, so uncommitted rows would be served to other callers
+type DB interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Row - a materialised row, column name -> value
+type Row map[string]interface{}
+
+// Cache - caching wrapper around a DB
+type Cache struct {
+	db       DB
+	cache    memoise.Cache
+	query    func(context.Context, stmt) ([]Row, error)
+	mu       *sync.Mutex
+	tags     map[string]map[string]struct{}
+	tagged   int // number of keys in tags
+	pruneAt  int
+	loading  map[string]int // keys being queried, these aren't cached yet, but mustn't be pruned
+	versions map[string]uint64
+}
+
+// stmt - query text and arguments, the argument for the memoised query function
+type stmt struct {
+	query string
+	args  []interface{}
+}
+
+// New - wrap db, caching query results in cache, opts configure the entries (TTL, refresh type, ...)
+func New(db DB, cache memoise.Cache, opts ...memoise.EntryConfig) *Cache {
+	c := &Cache{
+		db:       db,
+		cache:    cache,
+		mu:       &sync.Mutex{},
+		tags:     map[string]map[string]struct{}{},
+		pruneAt:  minPrune,
+		loading:  map[string]int{},
+		versions: map[string]uint64{},
+	}
+	c.query = memoise.FuncCtx(cache, keyName, c.load, opts...)
+	return c
+}
+
+// QueryContext - run a read-only query, returning the cached rows if available
+// the rows are copies, but values (e.g. []byte) are shared between callers, don't modify them
+// queries that aren't read-only are run every time, invalidating the cached results for their tables
+func (c *Cache) QueryContext(ctx context.Context, query string, args ...interface{}) ([]Row, error) {
+	s := stmt{
+		query: query,
+		args:  args,
+	}
+	if !readOnly(query) {
+		rows, err := c.load(ctx, s)
+		c.Invalidate(tablesOf(query)...)
+		return rows, err
+	}
+	key, err := memoise.FuncKey(keyName, s)
+	if err != nil {
+		return nil, err
+	}
+	tables := tablesOf(query)
+	if len(tables) == 0 {
+		// untagged, invalidated by all statements
+		tables = []string{""}
+	}
+	c.mu.Lock()
+	if c.tagged >= c.pruneAt {
+		c.prune()
+	}
+	for _, t := range tables {
+		if c.tags[t] == nil {
+			c.tags[t] = map[string]struct{}{}
+		}
+		if _, ok := c.tags[t][key]; !ok {
+			c.tags[t][key] = struct{}{}
+			c.tagged++
+		}
+	}
+	c.loading[key]++
+	// invalidation while querying would leave stale rows in the cache
+	version := c.version(tables)
+	c.mu.Unlock()
+	rows, err := c.query(ctx, s)
+	c.mu.Lock()
+	if c.loading[key]--; c.loading[key] == 0 {
+		delete(c.loading, key)
+	}
+	changed := c.version(tables) != version
+	c.mu.Unlock()
+	if changed {
+		c.cache.Unset(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Row, 0, len(rows))
+	for _, r := range rows {
+		cp := make(Row, len(r))
+		for k, v := range r {
+			cp[k] = v
+		}
+		out = append(out, cp)
+	}
+	return out, nil
+}
+
+// ExecContext - run a statement, invalidating the cached results for the tables it writes to
+func (c *Cache) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	res, err := c.db.ExecContext(ctx, query, args...)
+	// even if the statement failed, it could have changed some data
+	c.Invalidate(tablesOf(query)...)
+	return res, err
+}
+
+// Invalidate - remove the cached results tagged with the given tables, or all results if none are given
+// results of queries for which no table could be found are always removed
+func (c *Cache) Invalidate(tables ...string) {
+	c.mu.Lock()
+	if len(tables) == 0 {
+		for t := range c.tags {
+			tables = append(tables, t)
+		}
+	} else {
+		tables = append(tables, "")
+	}
+	var keys []string
+	for _, t := range tables {
+		t = normalise(t)
+		c.versions[t]++
+		for k := range c.tags[t] {
+			keys = append(keys, k)
+		}
+		c.tagged -= len(c.tags[t])
+		delete(c.tags, t)
+	}
+	c.mu.Unlock()
+	for _, k := range keys {
+		c.cache.Unset(k)
+	}
+}
+
+// prune - remove the keys that are no longer cached (expired, unset, ...) from the tags, caller must hold lock
+// pruning once the number of tagged keys doubles keeps the cost per query constant
+func (c *Cache) prune() {
+	c.tagged = 0
+	for t, keys := range c.tags {
+		for k := range keys {
+			if _, ok := c.loading[k]; !ok && !c.cache.Has(k) {
+				delete(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			delete(c.tags, t)
+		}
+		c.tagged += len(keys)
+	}
+	c.pruneAt = 2 * c.tagged
+	if c.pruneAt < minPrune {
+		c.pruneAt = minPrune
+	}
+}
+
+// version - combined version of the tables, caller must hold lock
+func (c *Cache) version(tables []string) uint64 {
+	var v uint64
+	for _, t := range tables {
+		v += c.versions[t]
+	}
+	return v
+}
+
+// load - run the query, materialising the rows
+func (c *Cache) load(ctx context.Context, s stmt) ([]Row, error) {
+	rows, err := c.db.QueryContext(ctx, s.query, s.args...)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	var out []Row
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r := make(Row, len(cols))
+		for i, col := range cols {
+			r[col] = vals[i]
+		}
+		out = append(out, r)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// readOnly - check whether the query only reads data, so its results can be cached
+func readOnly(query string) bool {
+	q := strings.TrimLeft(query, " \t\r\n(")
+	i := strings.IndexFunc(q, unicode.IsSpace)
+	if i < 0 {
+		i = len(q)
+	}
+	switch strings.ToLower(q[:i]) {
+	case "select", "with":
+		return !writeRE.MatchString(query)
+	}
+	return false
+}
+
+// tablesOf - extract table names from the SQL text
+// if a FROM list can't be parsed, no tables are returned, so the query is treated as unknown
+func tablesOf(query string) []string {
+	var tables []string
+	seen := map[string]struct{}{}
+	add := func(t string) {
+		t = normalise(t)
+		if _, ok := seen[t]; ok {
+			return
+		}
+		seen[t] = struct{}{}
+		tables = append(tables, t)
+	}
+	for _, m := range tableRE.FindAllStringSubmatch(query, -1) {
+		add(m[1])
+	}
+	for _, m := range fromRE.FindAllStringSubmatch(query, -1) {
+		if !strings.Contains(m[1], ",") {
+			continue
+		}
+		for _, item := range strings.Split(m[1], ",") {
+			im := fromItemRE.FindStringSubmatch(strings.TrimSpace(item))
+			if im == nil {
+				// subquery, function call, ...
+				return nil
+			}
+			add(im[1])
+		}
+	}
+	return tables
+}
+
+// normalise - table names are case insensitive, strip quotes and the schema
+func normalise(t string) string {
+	t = strings.ToLower(strings.Trim(t, "`\"[]"))
+	if i := strings.LastIndex(t, "."); i >= 0 {
+		t = t[i+1:]
+	}
+	return t
+}
@@ -0,0 +1,168 @@
+package sqlcache_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EVODelavega/go-memoise"
+	"github.com/EVODelavega/go-memoise/clocktest"
+	"github.com/EVODelavega/go-memoise/sqlcache"
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	ID   int    `db:"id"`
+	Name string `db:"name"`
+}
+
+func TestQueryInvalidate(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeDriver{}
+	db := newFakeDB(d)
+	c := sqlcache.New(db, memoise.New())
+	_, err := c.ExecContext(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", 1, "alice")
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		rows, err := c.QueryContext(ctx, "SELECT id, name FROM users WHERE id = ?", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []sqlcache.Row{{"id": int64(1), "name": "alice"}}, rows)
+	}
+	assert.Equal(t, int32(1), d.queryCount())
+	// different arguments, different entry
+	rows, err := c.QueryContext(ctx, "SELECT id, name FROM users WHERE id = ?", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+	assert.Equal(t, int32(2), d.queryCount())
+	// writing to the table invalidates all results for it
+	_, err = c.ExecContext(ctx, "UPDATE users SET name = ? WHERE id = ?", "bob", 1)
+	assert.NoError(t, err)
+	rows, err = c.QueryContext(ctx, "SELECT id, name FROM users WHERE id = ?", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", rows[0]["name"])
+	_, _ = c.QueryContext(ctx, "SELECT id, name FROM users WHERE id = ?", 2)
+	assert.Equal(t, int32(4), d.queryCount())
+	// returned rows are copies
+	rows[0]["name"] = "mallory"
+	rows, err = c.QueryContext(ctx, "SELECT id, name FROM users WHERE id = ?", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", rows[0]["name"])
+	// errors are not cached
+	_, err = c.QueryContext(ctx, "SELECT * FROM unknown")
+	assert.Error(t, err)
+}
+
+func TestQueryTables(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeDriver{}
+	db := newFakeDB(d)
+	c := sqlcache.New(db, memoise.New())
+	_, err := c.ExecContext(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", 1, "alice")
+	assert.NoError(t, err)
+	// all tables in a FROM list are tagged
+	join := "SELECT u.id, u.name FROM users u, orders AS o WHERE o.user_id = u.id"
+	_, err = c.QueryContext(ctx, join)
+	assert.NoError(t, err)
+	_, err = c.QueryContext(ctx, join)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), d.queryCount())
+	// the fake driver doesn't know the statement, but it still invalidates
+	_, err = c.ExecContext(ctx, "UPDATE orders SET total = 0")
+	assert.Error(t, err)
+	_, err = c.QueryContext(ctx, join)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), d.queryCount())
+	// FROM lists that can't be parsed are invalidated by any statement
+	unknown := "SELECT id, name FROM users, unnest(?, ?)"
+	_, err = c.QueryContext(ctx, unknown, 1, 2)
+	assert.NoError(t, err)
+	_, err = c.ExecContext(ctx, "UPDATE payments SET total = 0")
+	assert.Error(t, err)
+	_, err = c.QueryContext(ctx, unknown, 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), d.queryCount())
+}
+
+func TestQueryWrites(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeDriver{}
+	c := sqlcache.New(newFakeDB(d), memoise.New())
+	for i := 1; i <= 2; i++ {
+		_, err := c.ExecContext(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", i, "alice")
+		assert.NoError(t, err)
+	}
+	sel := "SELECT id, name FROM users WHERE id = ?"
+	_, err := c.QueryContext(ctx, sel, 1)
+	assert.NoError(t, err)
+	// locking rows isn't cached
+	for i := 0; i < 2; i++ {
+		rows, err := c.QueryContext(ctx, sel+" FOR UPDATE", 2)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 1)
+	}
+	assert.Equal(t, int32(3), d.queryCount())
+	// neither are writes, which invalidate the tables they write to
+	for i := 1; i <= 2; i++ {
+		rows, err := c.QueryContext(ctx, "DELETE FROM users WHERE id = ? RETURNING id, name", 1)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 2-i)
+	}
+	rows, err := c.QueryContext(ctx, sel, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+	assert.Equal(t, int32(6), d.queryCount())
+}
+
+// unsetCache - counts the calls to Unset
+type unsetCache struct {
+	memoise.Cache
+	unsets int32
+}
+
+func (c *unsetCache) Unset(key string) {
+	atomic.AddInt32(&c.unsets, 1)
+	c.Cache.Unset(key)
+}
+
+func TestQueryPrune(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeDriver{}
+	clock := clocktest.New(time.Now())
+	cache := &unsetCache{
+		Cache: memoise.New(memoise.WithClock(clock)),
+	}
+	c := sqlcache.New(newFakeDB(d), cache, memoise.SetTTL(time.Minute), memoise.SetRefreshType(memoise.NoRefresh))
+	query := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := c.QueryContext(ctx, "SELECT id, name FROM users WHERE id = ?", i)
+			assert.NoError(t, err)
+		}
+	}
+	query(0, 100)
+	clock.Advance(2 * time.Minute)
+	assert.Empty(t, cache.Stats().Keys)
+	// expired keys are pruned from the tags as new ones are added, so only the new ones are unset
+	query(100, 200)
+	c.Invalidate("users")
+	assert.Equal(t, int32(100), atomic.LoadInt32(&cache.unsets))
+}
+
+func TestQueryStructs(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeDriver{}
+	c := sqlcache.New(newFakeDB(d), memoise.New())
+	_, err := c.ExecContext(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", 1, "alice")
+	assert.NoError(t, err)
+	_, err = c.ExecContext(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", 2, "bob")
+	assert.NoError(t, err)
+	users, err := sqlcache.QueryStructs[user](ctx, c, "SELECT id, name FROM users")
+	assert.NoError(t, err)
+	assert.Equal(t, []user{{ID: 1, Name: "alice"}, {ID: 2, Name: "bob"}}, users)
+	_, err = sqlcache.QueryStructs[user](ctx, c, "SELECT id, name FROM users")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), d.queryCount())
+	// incompatible types
+	_, err = sqlcache.Scan[struct{ Name int }]([]sqlcache.Row{{"name": "alice"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,24 @@
+package memoise
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// staleValue - get the stale value to return after expiry, or on error
+// returns false (and no value) if the value is past its max staleness, caller must hold lock
+func (e *centry) staleValue(now time.Time) (interface{}, bool) {
+	if e.maxAge <= 0 {
+		return e.item.val, true
+	}
+	// how stale the value is depends on when it expired, not when the last error was cached
+	ref := e.item.deadline
+	if ref.IsZero() {
+		ref = e.item.expires
+	}
+	if ref.IsZero() || now.Sub(ref) <= e.maxAge {
+		return e.item.val, true
+	}
+	atomic.AddUint64(&e.tooStale, 1)
+	return nil, false
+}
@@ -0,0 +1,113 @@
+package memoise
+
+import (
+	"sync/atomic"
+)
+
+// versionSeq - source of value versions, shared by all caches, so versions only ever go up
+var versionSeq uint64
+
+func nextVersion() uint64 {
+	return atomic.AddUint64(&versionSeq, 1)
+}
+
+// GetWithVersion - get the cached value, error, and version. Expired values are not refreshed,
+// they are returned along with ErrValueExpired (unless a call error is cached)
+func (c *cache) GetWithVersion(key string) (interface{}, uint64, error) {
+	if c.life.isClosed() {
+		return nil, 0, ErrCacheClosed
+	}
+	c.mu.RLock()
+	ce, err := c.get(key)
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	ce.mu.RLock()
+	v, ver, err := ce.item.val, ce.item.version, ce.item.err
+	if err == nil && ce.item.expired(c.clock.Now()) {
+		err = ErrValueExpired
+	}
+	ce.mu.RUnlock()
+	return v, ver, err
+}
+
+// CompareAndSwap - replace the cached value for key, if its version still matches
+// the value is kept until the entry expires, and is refreshed as per usual
+func (c *cache) CompareAndSwap(key string, version uint64, value interface{}) error {
+	if !c.life.begin() {
+		return ErrCacheClosed
+	}
+	c.mu.RLock()
+	ce, err := c.get(key)
+	c.mu.RUnlock()
+	if err != nil {
+		c.life.end()
+		return err
+	}
+	ce.mu.Lock()
+	if ce.item.version != version {
+		ce.mu.Unlock()
+		c.life.end()
+		return ErrVersionMismatch
+	}
+	old := ce.item.val
+	ce.item.val = value
+	ce.item.err = nil
+	ce.setExpiry(nil)
+	ce.item.version = nextVersion()
+	c.manage(key, ce)
+	c.changed(key, old, value, nil, CauseSet)
+	ce.mu.Unlock()
+	c.invalidate(key)
+	c.life.end()
+	return nil
+}
+
+// GetWithVersion - get the value and its version, expired values are returned along with ErrValueExpired
+func (c *valCache) GetWithVersion(key string) (interface{}, uint64, error) {
+	if c.life.isClosed() {
+		return nil, 0, ErrCacheClosed
+	}
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	e.mu.RLock()
+	if e.item == nil {
+		e.mu.RUnlock()
+		return nil, 0, ErrKeyNotFound
+	}
+	v, ver := e.item.val, e.item.version
+	if e.item.expired(c.clock.Now()) {
+		e.mu.RUnlock()
+		return v, ver, ErrValueExpired
+	}
+	e.mu.RUnlock()
+	return v, ver, nil
+}
+
+// CompareAndSwap - set the value for key, if its version still matches
+func (c *valCache) CompareAndSwap(key string, version uint64, value interface{}, opts ...EntryConfig) error {
+	var err error
+	_, cErr := c.compute(key, func(it *citem, _ bool) (interface{}, computeOp) {
+		if it == nil {
+			err = ErrKeyNotFound
+			return nil, computeNone
+		}
+		if it.version != version {
+			err = ErrVersionMismatch
+			return nil, computeNone
+		}
+		return value, computeStore
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	if cErr == ErrCacheClosed {
+		return cErr
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package memoise
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// watchQueueSize - max number of events queued for a watcher, see watcher.push
+const watchQueueSize = 1024
+
+// watchers - registry of everyone watching keys
+type watchers struct {
+	mu     *sync.RWMutex
+	subs   map[*watcher]struct{}
+	closed bool
+}
+
+// watcher - a single subscription, events are queued so slow subscribers don't block writers
+type watcher struct {
+	key     string
+	prefix  bool
+	mu      *sync.Mutex
+	queue   []Event
+	dropped uint64        // events dropped or merged since the last event was delivered
+	wake    chan struct{} // signals events were queued
+	done    chan struct{}
+	out     chan Event
+	once    *sync.Once
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		mu:   &sync.RWMutex{},
+		subs: map[*watcher]struct{}{},
+	}
+}
+
+// start - stop all watchers once the context is cancelled
+func (w *watchers) start(ctx context.Context) {
+	<-ctx.Done()
+	w.mu.Lock()
+	w.closed = true
+	subs := w.subs
+	w.subs = map[*watcher]struct{}{}
+	w.mu.Unlock()
+	for s := range subs {
+		s.stop()
+	}
+}
+
+// add - register a new watcher, returns the channel and a func to stop watching
+func (w *watchers) add(key string, prefix bool) (<-chan Event, func()) {
+	s := &watcher{
+		key:    key,
+		prefix: prefix,
+		mu:     &sync.Mutex{},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		out:    make(chan Event),
+		once:   &sync.Once{},
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		close(s.out)
+		return s.out, func() {}
+	}
+	w.subs[s] = struct{}{}
+	w.mu.Unlock()
+	go s.run()
+	return s.out, func() {
+		w.mu.Lock()
+		delete(w.subs, s)
+		w.mu.Unlock()
+		s.stop()
+	}
+}
+
+// active - returns true if anyone is watching, so callers can skip building events
+func (w *watchers) active() bool {
+	w.mu.RLock()
+	n := len(w.subs)
+	w.mu.RUnlock()
+	return n > 0
+}
+
+// notify - queue the event for all watchers of its key, never blocks on subscribers
+func (w *watchers) notify(ev Event) {
+	w.mu.RLock()
+	for s := range w.subs {
+		if s.matches(ev.Key) {
+			s.push(ev)
+		}
+	}
+	w.mu.RUnlock()
+}
+
+func (s *watcher) matches(key string) bool {
+	if s.prefix {
+		return strings.HasPrefix(key, s.key)
+	}
+	return key == s.key
+}
+
+// push - queue the event, once the queue is full the event is merged into the last one queued for the
+// same key (keeping its old value), or dropped if there is none
+func (s *watcher) push(ev Event) {
+	s.mu.Lock()
+	if len(s.queue) < watchQueueSize {
+		s.queue = append(s.queue, ev)
+	} else {
+		s.dropped++
+		for i := len(s.queue) - 1; i >= 0; i-- {
+			if s.queue[i].Key == ev.Key {
+				ev.Old = s.queue[i].Old
+				s.queue[i] = ev
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// already signalled
+	}
+}
+
+// run - deliver queued events until the watcher is stopped, then close the channel
+func (s *watcher) run() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				close(s.out)
+				return
+			}
+		}
+		ev := s.queue[0]
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+		ev.Dropped, s.dropped = s.dropped, 0
+		s.mu.Unlock()
+		select {
+		case s.out <- ev:
+		case <-s.done:
+			close(s.out)
+			return
+		}
+	}
+}
+
+func (s *watcher) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Watch - get the changes to the given key, call the returned func to stop watching
+// the channel is closed once watching stops, or the cache is closed
+func (c *cache) Watch(key string) (<-chan Event, func()) {
+	return c.w.add(key, false)
+}
+
+// WatchPrefix - get the changes to all keys starting with the given prefix, see Watch
+func (c *cache) WatchPrefix(prefix string) (<-chan Event, func()) {
+	return c.w.add(prefix, true)
+}
+
+// changed - notify watchers of a change to the given key, callers hold the entry lock so events are
+// queued in the order the entry was written. Only takes the watcher locks, and never blocks on subscribers
+func (c *cache) changed(key string, old, v interface{}, err error, cause EventCause) {
+	c.w.notify(Event{
+		Key:   key,
+		Old:   old,
+		New:   v,
+		Err:   err,
+		Cause: cause,
+	})
+}